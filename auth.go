@@ -0,0 +1,236 @@
+package violifer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// 认证
+// 服务端通过 SetAuthenticator 设置认证方式后，握手时在回复协商后的 Option 之前认证客户端：
+// 服务端发送质询（确认帧，状态为 handshakeChallenge），客户端通过 Option.Credentials 计算回应（长度前缀 + JSON），
+// 可以有多轮质询，认证成功后服务端才回复协商后的 Option，认证失败时回复 handshakeUnauthenticated 并关闭连接，
+// 未通过认证的连接不会进入编解码阶段
+// 内置 HMAC 共享密钥质询和 Bearer 令牌两种方式，实现 Authenticator 和 Credentials 即可接入自定义的认证方式
+// 认证得到的 Principal 对连接上的所有请求生效，服务方法和拦截器通过 PrincipalFromContext 得到
+// 没有设置认证方式时，双向 TLS 连接使用经过验证的客户端证书作为 Principal，Scheme 为 SchemeTLS，Name 为证书的 CommonName
+
+// 客户端没有通过认证
+var ErrUnauthenticated = NewError(CodeUnauthenticated, "rpc - unauthenticated")
+
+// 通过认证的客户端身份
+type Principal struct {
+	// 认证方式
+	Scheme string
+	// 客户端的名字，例如 HMAC 的密钥 ID、令牌对应的用户
+	Name string
+}
+
+// 认证过程中服务端与客户端的连接
+type AuthConn interface {
+	// 向客户端发送质询，返回客户端的回应
+	Challenge(challenge []byte) ([]byte, error)
+}
+
+// 服务端的认证方式
+type Authenticator interface {
+	// 认证方式的名字，与客户端 Credentials 的 Scheme 一致才会进行认证
+	Scheme() string
+	// 通过 conn 质询客户端，认证成功时返回客户端身份，失败时返回的错误信息会发送给客户端
+	Authenticate(conn AuthConn) (*Principal, error)
+}
+
+// 客户端的认证凭据
+type Credentials interface {
+	// 认证方式的名字
+	Scheme() string
+	// 根据服务端的质询计算回应
+	Respond(challenge []byte) ([]byte, error)
+}
+
+// 设置认证方式，nil 表示不需要认证，只对之后建立的连接生效
+func (server *Server) SetAuthenticator(auth Authenticator) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.authenticator = auth
+}
+
+// 设置默认 Server 的认证方式
+func SetAuthenticator(auth Authenticator) {
+	DefaultServer.SetAuthenticator(auth)
+}
+
+// 握手时认证客户端，服务端没有设置认证方式时返回 nil
+func (server *Server) authenticate(conn io.ReadWriter, scheme string) (*Principal, error) {
+	server.mutex.Lock()
+	auth := server.authenticator
+	server.mutex.Unlock()
+	if auth == nil {
+		return nil, nil
+	}
+
+	if scheme != auth.Scheme() {
+		return nil, errors.New("authentication required, scheme " + auth.Scheme())
+	}
+	principal, err := auth.Authenticate(&handshakeAuthConn{rw: conn})
+	if err == nil && principal == nil {
+		err = errors.New("no principal")
+	}
+	return principal, err
+}
+
+// 通过确认帧发送质询，读取长度前缀的回应
+type handshakeAuthConn struct {
+	rw io.ReadWriter
+}
+
+func (c *handshakeAuthConn) Challenge(challenge []byte) ([]byte, error) {
+	if err := writeAck(c.rw, handshakeChallenge, &handshakeAck{Challenge: challenge}); err != nil {
+		return nil, err
+	}
+	var response []byte
+	if err := readBlock(c.rw, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// 返回处理当前请求的连接认证得到的客户端身份，没有认证也没有客户端证书时返回 false
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := PeerFromContext(ctx)
+	if !ok || p.principal == nil {
+		return nil, false
+	}
+	return p.principal, true
+}
+
+// 返回连接认证得到的客户端身份，没有认证也没有客户端证书时返回 nil
+func (p *Peer) Principal() *Principal {
+	return p.principal
+}
+
+const (
+	SchemeHMAC = "hmac-sha256"
+	SchemeBearer = "bearer"
+	// 双向 TLS 的客户端证书，不是握手认证方式，只用于 Principal.Scheme
+	SchemeTLS = "tls"
+)
+
+// HMAC 质询的随机数长度
+const hmacNonceSize = 32
+
+// HMAC 质询的回应
+type hmacResponse struct {
+	ID string
+	MAC []byte
+}
+
+// 共享密钥的 HMAC 质询认证，密钥不在连接上传输
+// 服务端发送随机数，客户端回应密钥 ID 和 HMAC-SHA256(密钥, 随机数)，Principal 的 Name 为密钥 ID
+type hmacAuthenticator struct {
+	keys map[string][]byte
+}
+
+// 创建 HMAC 认证方式，keys 为密钥 ID 到密钥的映射
+func NewHMACAuthenticator(keys map[string][]byte) Authenticator {
+	a := &hmacAuthenticator{keys: make(map[string][]byte, len(keys))}
+	for id, key := range keys {
+		a.keys[id] = key
+	}
+	return a
+}
+
+func (a *hmacAuthenticator) Scheme() string {
+	return SchemeHMAC
+}
+
+func (a *hmacAuthenticator) Authenticate(conn AuthConn) (*Principal, error) {
+	nonce := make([]byte, hmacNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	data, err := conn.Challenge(nonce)
+	if err != nil {
+		return nil, err
+	}
+	var resp hmacResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, errors.New("invalid hmac response")
+	}
+	key, ok := a.keys[resp.ID]
+	if !ok || !hmac.Equal(resp.MAC, hmacSum(key, nonce)) {
+		return nil, errors.New("invalid hmac key")
+	}
+	return &Principal{Scheme: SchemeHMAC, Name: resp.ID}, nil
+}
+
+func hmacSum(key, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+type hmacCredentials struct {
+	id string
+	key []byte
+}
+
+// 创建 HMAC 认证凭据
+func HMACCredentials(id string, key []byte) Credentials {
+	return &hmacCredentials{id: id, key: key}
+}
+
+func (c *hmacCredentials) Scheme() string {
+	return SchemeHMAC
+}
+
+func (c *hmacCredentials) Respond(challenge []byte) ([]byte, error) {
+	return json.Marshal(&hmacResponse{ID: c.id, MAC: hmacSum(c.key, challenge)})
+}
+
+// Bearer 令牌认证，令牌以明文传输，应当与 TLS 一起使用
+// 服务端发送空的质询，客户端回应令牌，由 verify 校验令牌并返回客户端的名字
+type bearerAuthenticator struct {
+	verify func(token string) (string, error)
+}
+
+// 创建 Bearer 令牌认证方式
+func NewBearerAuthenticator(verify func(token string) (string, error)) Authenticator {
+	return &bearerAuthenticator{verify: verify}
+}
+
+func (a *bearerAuthenticator) Scheme() string {
+	return SchemeBearer
+}
+
+func (a *bearerAuthenticator) Authenticate(conn AuthConn) (*Principal, error) {
+	token, err := conn.Challenge(nil)
+	if err != nil {
+		return nil, err
+	}
+	name, err := a.verify(string(token))
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{Scheme: SchemeBearer, Name: name}, nil
+}
+
+type bearerCredentials string
+
+// 创建 Bearer 令牌认证凭据
+func BearerCredentials(token string) Credentials {
+	return bearerCredentials(token)
+}
+
+func (c bearerCredentials) Scheme() string {
+	return SchemeBearer
+}
+
+func (c bearerCredentials) Respond(challenge []byte) ([]byte, error) {
+	return []byte(c), nil
+}
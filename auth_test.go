@@ -0,0 +1,128 @@
+package violifer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// 返回连接认证得到的客户端身份
+type Account struct {
+	calls int32
+}
+
+func (a *Account) Whoami(ctx context.Context, args int, reply *string) error {
+	atomic.AddInt32(&a.calls, 1)
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		*reply = principal.Scheme + ":" + principal.Name
+	}
+	return nil
+}
+
+// 两轮质询的自定义认证：服务端依次发送两个数字，客户端回应它们的和与积
+type sumAuthenticator struct{}
+
+func (sumAuthenticator) Scheme() string {
+	return "sum"
+}
+
+func (sumAuthenticator) Authenticate(conn AuthConn) (*Principal, error) {
+	sum, err := conn.Challenge([]byte("3+4"))
+	if err != nil || string(sum) != "7" {
+		return nil, errors.New("wrong sum")
+	}
+	product, err := conn.Challenge([]byte("3*4"))
+	if err != nil || string(product) != "12" {
+		return nil, errors.New("wrong product")
+	}
+	return &Principal{Scheme: "sum", Name: "solver"}, nil
+}
+
+type sumCredentials struct{}
+
+func (sumCredentials) Scheme() string {
+	return "sum"
+}
+
+func (sumCredentials) Respond(challenge []byte) ([]byte, error) {
+	a, b := int(challenge[0]-'0'), int(challenge[2]-'0')
+	if challenge[1] == '+' {
+		return []byte(strconv.Itoa(a + b)), nil
+	}
+	return []byte(strconv.Itoa(a * b)), nil
+}
+
+// 认证成功的连接上的请求都带有客户端身份，认证失败的连接在握手时被拒绝，不会调用服务方法
+func TestServer_SetAuthenticator(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		auth Authenticator
+		cred Credentials
+		// 为空表示认证失败
+		want string
+	}{
+		{"hmac", NewHMACAuthenticator(map[string][]byte{"app": []byte("secret")}),
+			HMACCredentials("app", []byte("secret")), "hmac-sha256:app"},
+		{"hmac wrong key", NewHMACAuthenticator(map[string][]byte{"app": []byte("secret")}),
+			HMACCredentials("app", []byte("guess")), ""},
+		{"hmac unknown id", NewHMACAuthenticator(map[string][]byte{"app": []byte("secret")}),
+			HMACCredentials("other", []byte("secret")), ""},
+		{"bearer", NewBearerAuthenticator(verifyToken), BearerCredentials("token-alice"), "bearer:alice"},
+		{"bearer invalid token", NewBearerAuthenticator(verifyToken), BearerCredentials("forged"), ""},
+		{"custom", sumAuthenticator{}, sumCredentials{}, "sum:solver"},
+		{"no credentials", NewBearerAuthenticator(verifyToken), nil, ""},
+		{"wrong scheme", NewBearerAuthenticator(verifyToken), HMACCredentials("app", []byte("secret")), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := new(Account)
+			server := NewServer()
+			_ = server.Register(account)
+			server.SetAuthenticator(tt.auth)
+			l, _ := net.Listen("tcp", ":0")
+			go server.Accept(l)
+			defer func() { _ = l.Close() }()
+
+			client, err := Dial("tcp", l.Addr().String(), &Option{Credentials: tt.cred})
+			if tt.want == "" {
+				_assert(errors.Is(err, ErrUnauthenticated), "expect ErrUnauthenticated, got %v", err)
+				_assert(atomic.LoadInt32(&account.calls) == 0, "expect no method to be called")
+				return
+			}
+			_assert(err == nil, "failed to authenticate: %v", err)
+			defer func() { _ = client.Close() }()
+			for i := 0; i < 2; i++ {
+				var reply string
+				err = client.Call(context.Background(), "Account.Whoami", i, &reply)
+				_assert(err == nil && reply == tt.want, "expect principal %s, got %s, %v", tt.want, reply, err)
+			}
+		})
+	}
+}
+
+func verifyToken(token string) (string, error) {
+	if token == "token-alice" {
+		return "alice", nil
+	}
+	return "", errors.New("invalid token")
+}
+
+// 服务端没有设置认证方式时，带有认证凭据的客户端也可以连接，请求没有客户端身份
+func TestServer_WithoutAuthenticator(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Account))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{Credentials: BearerCredentials("token-alice")})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	reply := "unset"
+	err = client.Call(context.Background(), "Account.Whoami", 1, &reply)
+	_assert(err == nil && reply == "", "expect no principal, got %q, %v", reply, err)
+}
@@ -0,0 +1,212 @@
+package violifer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// 授权
+// 服务端通过 SetPolicy 设置授权策略后，每个请求在调用服务方法之前按照 ServiceMethod 和连接认证得到的 Principal 检查权限，
+// 没有权限的请求返回错误码为 CodePermissionDenied 的错误，不会经过拦截器和服务方法
+// 策略可以通过 Go 代码构造，也可以通过 LoadPolicy 从 JSON 文件读取，例如：
+// {
+//   "Default": "deny",
+//   "Rules": [
+//     {"Methods": ["Admin.*"], "Principals": ["root"], "Effect": "allow"},
+//     {"Methods": ["Admin.*"], "Effect": "deny"},
+//     {"Methods": ["Arith.*"], "Effect": "allow"}
+//   ]
+// }
+// SetPolicy 和 Server.LoadPolicy 可以在运行时随时调用，之后收到的请求使用新的策略
+
+// 客户端没有权限调用服务方法
+var ErrPermissionDenied = NewError(CodePermissionDenied, "rpc - permission denied")
+
+const (
+	EffectAllow = "allow"
+	EffectDeny = "deny"
+)
+
+// 授权规则
+type Rule struct {
+	// 匹配的 ServiceMethod，支持 path.Match 的通配符，例如 "Admin.*"、"*.Get*"、"*"
+	Methods []string
+	// 匹配的客户端，为空时匹配所有客户端，包括没有认证的客户端；不为空时不匹配没有认证的客户端
+	// "alice" 匹配任意认证方式下名字为 alice 的客户端，"tls:alice" 只匹配 Scheme 为 tls 的客户端
+	// 模式在第一个 : 处分为认证方式和名字，名字本身包含 : 时需要带上认证方式，例如 "tls:spiffe://example.org/*"
+	// 名字支持 * 和 ? 通配符，* 可以匹配包含 / 的名字
+	Principals []string `json:",omitempty"`
+	// allow 或 deny
+	Effect string
+}
+
+// 授权策略，规则按照顺序匹配，第一条同时匹配 ServiceMethod 和客户端的规则决定是否允许，没有匹配的规则时使用 Default
+type Policy struct {
+	Rules []Rule
+	// 没有匹配的规则时的结果，allow 或 deny，为空时为 deny
+	Default string `json:",omitempty"`
+}
+
+// 检查策略是否合法
+func (p *Policy) validate() error {
+	if p.Default != "" && p.Default != EffectAllow && p.Default != EffectDeny {
+		return fmt.Errorf("rpc - invalid policy default %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return fmt.Errorf("rpc - invalid effect %q in rule %d", rule.Effect, i)
+		}
+		if len(rule.Methods) == 0 {
+			return fmt.Errorf("rpc - no methods in rule %d", i)
+		}
+		for _, pattern := range rule.Methods {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rpc - invalid pattern %q in rule %d: %v", pattern, i, err)
+			}
+		}
+		for _, pattern := range rule.Principals {
+			if scheme, name, ok := strings.Cut(pattern, ":"); pattern == "" || (ok && (scheme == "" || name == "")) {
+				return fmt.Errorf("rpc - invalid principal %q in rule %d", pattern, i)
+			}
+		}
+	}
+	return nil
+}
+
+// 返回 principal 能否调用 serviceMethod，principal 为 nil 表示没有认证的客户端
+func (p *Policy) Allow(principal *Principal, serviceMethod string) bool {
+	for _, rule := range p.Rules {
+		if matchAny(rule.Methods, serviceMethod) && (len(rule.Principals) == 0 || matchPrincipal(rule.Principals, principal)) {
+			return rule.Effect == EffectAllow
+		}
+	}
+	return p.Default == EffectAllow
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// principal 是否匹配任意一个模式，没有认证的客户端不匹配任何模式
+func matchPrincipal(patterns []string, principal *Principal) bool {
+	if principal == nil || principal.Name == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if scheme, name, ok := strings.Cut(pattern, ":"); ok {
+			if scheme == principal.Scheme && globMatch(name, principal.Name) {
+				return true
+			}
+			continue
+		}
+		if globMatch(pattern, principal.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// 通配符匹配，* 匹配任意字符串（包括 /），? 匹配任意一个字符，其他字符按原样匹配
+func globMatch(pattern, s string) bool {
+	// 上一个 * 的位置，以及回溯时 s 的位置
+	star, next := -1, 0
+	px, sx := 0, 0
+	for px < len(pattern) || sx < len(s) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				star, next = px, sx
+				px++
+				continue
+			case '?':
+				if sx < len(s) {
+					_, n := utf8.DecodeRuneInString(s[sx:])
+					px, sx = px+1, sx+n
+					continue
+				}
+			default:
+				if sx < len(s) && s[sx] == c {
+					px, sx = px+1, sx+1
+					continue
+				}
+			}
+		}
+		// 不匹配时让上一个 * 多匹配一个字符
+		if star >= 0 && next < len(s) {
+			_, n := utf8.DecodeRuneInString(s[next:])
+			next += n
+			px, sx = star+1, next
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// 从 JSON 文件读取授权策略
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("rpc - invalid policy file %s: %v", file, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// 设置授权策略，nil 表示不检查权限，可以在运行时调用
+func (server *Server) SetPolicy(p *Policy) error {
+	if p != nil {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.policy = p
+	return nil
+}
+
+// 从 JSON 文件读取并设置授权策略，再次调用即重新加载，文件不合法时保留原来的策略
+func (server *Server) LoadPolicy(file string) error {
+	p, err := LoadPolicy(file)
+	if err != nil {
+		return err
+	}
+	return server.SetPolicy(p)
+}
+
+// 设置默认 Server 的授权策略
+func SetPolicy(p *Policy) error {
+	return DefaultServer.SetPolicy(p)
+}
+
+// 检查 principal 能否调用 serviceMethod
+func (server *Server) authorize(principal *Principal, serviceMethod string) error {
+	server.mutex.Lock()
+	p := server.policy
+	server.mutex.Unlock()
+	if p == nil || p.Allow(principal, serviceMethod) {
+		return nil
+	}
+	name := "unauthenticated client"
+	if principal != nil {
+		name = principal.Name
+	}
+	return Errorf(CodePermissionDenied, "%s: %s may not call %s", ErrPermissionDenied, name, serviceMethod)
+}
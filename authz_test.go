@@ -0,0 +1,218 @@
+package violifer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type Admin int
+
+func (a Admin) Reset(args int, reply *int) error {
+	*reply = args
+	return nil
+}
+
+func (a Admin) Stats(args int, reply *int) error {
+	*reply = args
+	return nil
+}
+
+func TestPolicy_Allow(t *testing.T) {
+	p := &Policy{
+		Rules: []Rule{
+			{Methods: []string{"Admin.*"}, Principals: []string{"root", "ops-*"}, Effect: EffectAllow},
+			{Methods: []string{"Admin.Stats"}, Principals: []string{"*"}, Effect: EffectAllow},
+			{Methods: []string{"Admin.*"}, Effect: EffectDeny},
+			{Methods: []string{"*.Get*"}, Effect: EffectAllow},
+		},
+	}
+	_assert(p.validate() == nil, "expect the policy to be valid")
+	tests := []struct {
+		principal *Principal
+		method string
+		want bool
+	}{
+		{&Principal{Name: "root"}, "Admin.Reset", true},
+		{&Principal{Name: "ops-1"}, "Admin.Reset", true},
+		{&Principal{Name: "alice"}, "Admin.Reset", false},
+		{&Principal{Name: "alice"}, "Admin.Stats", true},
+		{nil, "Admin.Stats", false},
+		{&Principal{Name: ""}, "Admin.Stats", false},
+		{nil, "Admin.Reset", false},
+		{nil, "Config.GetAll", true},
+		{&Principal{Name: "alice"}, "Config.Set", false},
+	}
+	for _, tt := range tests {
+		_assert(p.Allow(tt.principal, tt.method) == tt.want, "%v calling %s: expect %v", tt.principal, tt.method, tt.want)
+	}
+	p.Default = EffectAllow
+	_assert(p.Allow(nil, "Config.Set"), "expect the default to allow")
+
+	_assert((&Policy{Default: "maybe"}).validate() != nil, "expect an invalid default to be rejected")
+	_assert((&Policy{Rules: []Rule{{Methods: []string{"Admin.*"}}}}).validate() != nil, "expect a rule without effect to be rejected")
+	_assert((&Policy{Rules: []Rule{{Methods: []string{"*"}, Principals: []string{":alice"}, Effect: EffectDeny}}}).validate() != nil,
+		"expect a principal without scheme to be rejected")
+	_assert((&Policy{Rules: []Rule{{Methods: []string{"Admin.["}, Effect: EffectDeny}}}).validate() != nil,
+		"expect a malformed pattern to be rejected")
+}
+
+// 带有认证方式的模式只匹配该认证方式，通配符可以匹配包含 / 的名字
+func TestPolicy_AllowPrincipal(t *testing.T) {
+	p := &Policy{
+		Rules: []Rule{
+			{Methods: []string{"Admin.*"}, Principals: []string{"tls:alice", "tls:spiffe://example.org/*"}, Effect: EffectAllow},
+			{Methods: []string{"Config.*"}, Principals: []string{"*"}, Effect: EffectAllow},
+			{Methods: []string{"Audit.*"}, Principals: []string{"bearer:ops-?"}, Effect: EffectAllow},
+		},
+		Default: EffectDeny,
+	}
+	_assert(p.validate() == nil, "expect the policy to be valid")
+	tests := []struct {
+		principal *Principal
+		method string
+		want bool
+	}{
+		{&Principal{Scheme: SchemeTLS, Name: "alice"}, "Admin.Reset", true},
+		{&Principal{Scheme: SchemeBearer, Name: "alice"}, "Admin.Reset", false},
+		{&Principal{Scheme: SchemeTLS, Name: "spiffe://example.org/ns/prod/sa/api"}, "Admin.Reset", true},
+		{&Principal{Scheme: SchemeTLS, Name: "spiffe://evil.org/api"}, "Admin.Reset", false},
+		{&Principal{Scheme: SchemeHMAC, Name: "team/bob"}, "Config.Set", true},
+		{nil, "Config.Set", false},
+		{&Principal{Scheme: SchemeBearer, Name: "ops-1"}, "Audit.Read", true},
+		{&Principal{Scheme: SchemeBearer, Name: "ops-12"}, "Audit.Read", false},
+		{&Principal{Scheme: SchemeHMAC, Name: "ops-1"}, "Audit.Read", false},
+	}
+	for _, tt := range tests {
+		_assert(p.Allow(tt.principal, tt.method) == tt.want, "%v calling %s: expect %v", tt.principal, tt.method, tt.want)
+	}
+
+	globs := []struct {
+		pattern, s string
+		want bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"*/*", "a/b/c", true},
+		{"a?c", "a中c", true},
+		{"a*b*c", "axbyc", true},
+		{"abc", "ab", false},
+	}
+	for _, g := range globs {
+		_assert(globMatch(g.pattern, g.s) == g.want, "glob %q on %q: expect %v", g.pattern, g.s, g.want)
+	}
+}
+
+// 没有权限的请求返回 ErrPermissionDenied，策略文件可以在运行时重新加载
+func TestServer_LoadPolicy(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Admin))
+	_ = server.Register(new(Baz))
+	server.SetAuthenticator(NewBearerAuthenticator(func(token string) (string, error) {
+		return token, nil
+	}))
+	file := filepath.Join(t.TempDir(), "policy.json")
+	write := func(content string) {
+		_assert(os.WriteFile(file, []byte(content), 0600) == nil, "failed to write the policy file")
+	}
+	write(`{"Rules": [
+		{"Methods": ["Admin.*"], "Principals": ["root"], "Effect": "allow"},
+		{"Methods": ["Admin.*"], "Effect": "deny"}
+	], "Default": "allow"}`)
+	_assert(server.LoadPolicy(file) == nil, "failed to load the policy")
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	dial := func(name string) *Client {
+		client, err := Dial("tcp", l.Addr().String(), &Option{Credentials: BearerCredentials(name)})
+		_assert(err == nil, "failed to dial as %s: %v", name, err)
+		return client
+	}
+	root, alice := dial("root"), dial("alice")
+	defer func() { _ = root.Close() }()
+	defer func() { _ = alice.Close() }()
+	call := func(client *Client, method string) error {
+		var reply int
+		if method == "Baz.Sum" {
+			return client.Call(context.Background(), method, &BazArgs{Num1: 1, Num2: 2}, &reply)
+		}
+		return client.Call(context.Background(), method, 1, &reply)
+	}
+
+	_assert(call(root, "Admin.Reset") == nil, "expect root to reset")
+	err := call(alice, "Admin.Reset")
+	_assert(errors.Is(err, ErrPermissionDenied), "expect alice to be denied, got %v", err)
+	_assert(call(alice, "Baz.Sum") == nil, "expect alice to call Baz.Sum")
+
+	// 重新加载后，已经建立的连接也使用新的策略
+	write(`{"Rules": [{"Methods": ["Admin.Stats"], "Effect": "allow"}]}`)
+	_assert(server.LoadPolicy(file) == nil, "failed to reload the policy")
+	_assert(call(alice, "Admin.Stats") == nil, "expect alice to read stats after reload")
+	_assert(errors.Is(call(root, "Admin.Reset"), ErrPermissionDenied), "expect root to be denied after reload")
+	_assert(errors.Is(call(alice, "Baz.Sum"), ErrPermissionDenied), "expect the default to deny")
+
+	// 文件不合法时保留原来的策略
+	write(`{"Rules": [{"Methods": ["Admin.*"], "Effect": "permit"}]}`)
+	_assert(server.LoadPolicy(file) != nil, "expect an invalid policy file to be rejected")
+	_assert(call(alice, "Admin.Stats") == nil, "expect the previous policy to be kept")
+
+	// 通过 Go 代码设置，nil 表示不检查权限
+	_assert(server.SetPolicy(nil) == nil, "failed to clear the policy")
+	_assert(call(alice, "Admin.Reset") == nil, "expect no authorization without a policy")
+}
+
+// 没有设置认证方式时，双向 TLS 的客户端证书作为 Principal 参与授权
+func TestServer_PolicyTLS(t *testing.T) {
+	t.Parallel()
+	caCert, caKey, _ := issueCert("test ca", nil, nil, 1)
+	_, _, serverCert := issueCert("server", caCert, caKey, 2)
+	_, _, aliceCert := issueCert("alice", caCert, caKey, 3)
+	_, _, bobCert := issueCert("bob", caCert, caKey, 4)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	server := NewServer()
+	_ = server.Register(new(Admin))
+	_ = server.Register(new(Account))
+	_ = server.SetPolicy(&Policy{
+		Rules: []Rule{{Methods: []string{"Admin.*"}, Principals: []string{"alice"}, Effect: EffectAllow}},
+		Default: EffectDeny,
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.AcceptTLS(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs: pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	})
+
+	dial := func(cert tls.Certificate) *Client {
+		client, err := XDial("tls@"+l.Addr().String(), &Option{
+			MagicNumber: MagicNumber,
+			CodecType: DefaultOption.CodecType,
+			TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}},
+		})
+		_assert(err == nil, "failed to dial with tls: %v", err)
+		return client
+	}
+	alice, bob := dial(aliceCert), dial(bobCert)
+	defer func() { _ = alice.Close() }()
+	defer func() { _ = bob.Close() }()
+
+	var reply int
+	err := alice.Call(context.Background(), "Admin.Reset", 1, &reply)
+	_assert(err == nil, "expect alice to reset: %v", err)
+	err = bob.Call(context.Background(), "Admin.Reset", 1, &reply)
+	_assert(errors.Is(err, ErrPermissionDenied), "expect bob to be denied, got %v", err)
+
+	_ = server.SetPolicy(nil)
+	var name string
+	err = alice.Call(context.Background(), "Account.Whoami", 1, &name)
+	_assert(err == nil && name == SchemeTLS+":alice", "expect the principal from the certificate, got %q, %v", name, err)
+}
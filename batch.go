@@ -0,0 +1,128 @@
+package violifer
+
+import (
+	"context"
+	"sync/atomic"
+	"violifer/codec"
+)
+
+// 批量调用，将多个请求在一次加锁、一次刷新中发送，减少大量小请求的系统调用次数
+// 例如：
+// batch := client.Batch()
+// batch.Add("Foo.Sum", &Args{1, 2}, &sum)
+// batch.Add("Foo.Echo", "hello", &echo)
+// errs := batch.Call(ctx)
+type Batch struct {
+	client *Client
+	calls []*Call
+}
+
+// 创建批量调用，批量调用不经过客户端拦截器
+func (client *Client) Batch() *Batch {
+	return &Batch{client: client}
+}
+
+// 添加一个请求，返回值写入 reply
+func (b *Batch) Add(serviceMethod string, args, reply interface{}) *Batch {
+	b.calls = append(b.calls, &Call{
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Reply: reply,
+	})
+	return b
+}
+
+// 返回已经添加的请求数
+func (b *Batch) Len() int {
+	return len(b.calls)
+}
+
+// 发送所有请求并等待全部完成，返回与添加顺序对应的错误，成功的请求对应 nil
+// ctx 的截止时间和元数据对所有请求生效，ctx 结束时仍未完成的请求通知服务端取消
+func (b *Batch) Call(ctx context.Context) []error {
+	client := b.client
+	for _, call := range b.calls {
+		call.ctx = ctx
+		call.Done = make(chan *Call, 1)
+	}
+
+	client.sendingMutex.Lock()
+	bw, ok := client.cc.(codec.BatchWriter)
+	if ok {
+		bw.Hold()
+	}
+	for _, call := range b.calls {
+		client.writeCall(call)
+	}
+	if ok {
+		if err := bw.Flush(); err != nil {
+			for _, call := range b.calls {
+				if client.removeCall(call.Seq) != nil {
+					call.Error = err
+					call.done()
+				}
+			}
+		}
+	}
+	client.sendingMutex.Unlock()
+
+	errs := make([]error, len(b.calls))
+	for i, call := range b.calls {
+		select {
+		case <- call.Done:
+			errs[i] = call.Error
+		case <- ctx.Done():
+			if client.removeCall(call.Seq) != nil {
+				client.cancel(call.Seq)
+				errs[i] = contextError("rpc client - call failed", ctx.Err())
+			} else {
+				errs[i] = (<- call.Done).Error
+			}
+		}
+	}
+	return errs
+}
+
+// 合并响应刷新的编解码器
+// 发送响应前在 waiting 中登记，写入后仍有响应在等待 sendingMutex 时不刷新，由最后一个写入的响应统一刷新，
+// 多个响应同时完成时只刷新一次
+type coalescingCodec struct {
+	codec.Codec
+	bw codec.BatchWriter
+	// 正在等待 sendingMutex 的响应数
+	waiting int32
+}
+
+func newCoalescingCodec(cc codec.Codec, bw codec.BatchWriter) *coalescingCodec {
+	return &coalescingCodec{Codec: cc, bw: bw}
+}
+
+// 调用方持有 sendingMutex
+func (c *coalescingCodec) Write(h *codec.Header, body interface{}) error {
+	c.bw.Hold()
+	err := c.Codec.Write(h, body)
+	if atomic.LoadInt32(&c.waiting) == 0 {
+		if ferr := c.bw.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// 被包装的 Codec 对消息体类型有要求时，由它检查
+func (c *coalescingCodec) CheckBody(body interface{}) error {
+	if bc, ok := c.Codec.(codec.BodyChecker); ok {
+		return bc.CheckBody(body)
+	}
+	return nil
+}
+
+// 合并同一连接上同时完成的响应的刷新，默认关闭
+// 开启后同一连接上排队发送的响应写入同一个缓冲，由最后一个响应统一刷新，高并发时减少系统调用
+// 只对之后建立的连接生效
+func (server *Server) SetCoalesceFlush(enable bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.coalesceFlush = enable
+}
@@ -0,0 +1,117 @@
+package violifer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"violifer/codec"
+)
+
+// 统计写入连接的次数
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+// 批量调用的所有请求只写入连接一次，每个请求的错误单独返回
+func TestClient_Batch(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Baz))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		counting := &countingConn{Conn: conn}
+		client, err := NewClient(counting, &Option{MagicNumber: MagicNumber, CodecType: codecType})
+		_assert(err == nil, "%s: failed to create client: %v", codecType, err)
+
+		const n = 20
+		sums := make([]int, n)
+		batch := client.Batch()
+		for i := 0; i < n; i++ {
+			batch.Add("Baz.Sum", &BazArgs{Num1: i, Num2: i}, &sums[i])
+		}
+		var missing int
+		batch.Add("Baz.Missing", &BazArgs{}, &missing)
+
+		before := atomic.LoadInt64(&counting.writes)
+		errs := batch.Call(context.Background())
+		_assert(atomic.LoadInt64(&counting.writes)-before == 1, "%s: expect a single write, got %d",
+			codecType, atomic.LoadInt64(&counting.writes)-before)
+		_assert(len(errs) == n+1, "%s: expect %d errors, got %d", codecType, n+1, len(errs))
+		for i := 0; i < n; i++ {
+			_assert(errs[i] == nil && sums[i] == 2*i, "%s: entry %d failed: %v", codecType, i, errs[i])
+		}
+		_assert(errs[n] != nil && strings.Contains(errs[n].Error(), "can't find method"), "%s: expect the missing method to fail", codecType)
+		_ = client.Close()
+	}
+}
+
+// 统计写入次数的内存连接
+type countingBuffer struct {
+	bytes.Buffer
+	writes int
+}
+
+func (b *countingBuffer) Write(p []byte) (int, error) {
+	b.writes++
+	return b.Buffer.Write(p)
+}
+
+func (b *countingBuffer) Close() error {
+	return nil
+}
+
+// 开启合并刷新后，排队等待发送的响应写入同一个缓冲，只在最后一个响应写入后刷新一次
+func TestServer_CoalesceFlush(t *testing.T) {
+	t.Parallel()
+	const n = 50
+	conn := new(countingBuffer)
+	gc := codec.NewGobCodec(conn)
+	cc := newCoalescingCodec(gc, gc.(codec.BatchWriter))
+	server := NewServer()
+	sendingMutex := new(sync.Mutex)
+
+	// 持有锁，使所有响应都在等待
+	sendingMutex.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			server.sendResponse(cc, &codec.Header{ServiceMethod: "Gate.Pass", Seq: uint64(i)}, i, sendingMutex)
+		}(i)
+	}
+	for atomic.LoadInt32(&cc.waiting) != n {
+		runtime.Gosched()
+	}
+	sendingMutex.Unlock()
+	wg.Wait()
+	_assert(conn.writes == 1, "expect the responses to be flushed once, got %d writes", conn.writes)
+
+	// 没有其他响应等待时立即刷新
+	server.sendResponse(cc, &codec.Header{ServiceMethod: "Gate.Pass", Seq: n}, n, sendingMutex)
+	_assert(conn.writes == 2, "expect a single response to be flushed immediately, got %d writes", conn.writes)
+
+	dec := codec.NewGobCodec(&countingBuffer{Buffer: conn.Buffer})
+	seen := make(map[uint64]bool)
+	for i := 0; i <= n; i++ {
+		var h codec.Header
+		var body int
+		_assert(dec.ReadHeader(&h) == nil && dec.ReadBody(&body) == nil && body == int(h.Seq), "failed to decode response %d", i)
+		seen[h.Seq] = true
+	}
+	_assert(len(seen) == n+1, "expect %d distinct responses, got %d", n+1, len(seen))
+}
@@ -3,7 +3,7 @@ package violifer
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -33,8 +33,14 @@ type Call struct {
 	Reply interface{}
 	// 错误信息
 	Error error
+	// 服务端返回的响应元数据
+	Metadata Metadata
 	// 支持异步调用管道
 	Done chan *Call
+	// 调用方的 context，用于向服务端传递截止时间和请求元数据
+	ctx context.Context
+	// 服务端流式调用，数据帧交给 stream 处理
+	stream *ClientStream
 }
 
 // 当调用结束时，调用 done 方法同时调用方
@@ -63,26 +69,56 @@ type Client struct {
 	closing bool
 	// 表明客户端不可用，有错误发生，被动关闭
 	shutdown bool
+	// 表明客户端不可用，服务端正在关闭，已经发送的请求仍会收到响应
+	goingAway bool
+	// 未完成的请求全部结束后关闭客户端
+	closeWhenIdle bool
+	// 通过 Use 添加的客户端拦截器，在 Option 中的拦截器之后执行
+	interceptors []ClientInterceptor
+	// 处理服务端回调请求的本地服务
+	handler *Server
+	// 客户端不能再发送新的请求时关闭，包括连接断开、用户关闭和服务端正在关闭
+	unavailable chan struct{}
+	// 服务端的幂等方法，由服务端在握手时告知
+	idempotent []string
 }
 
 // 创建 client 实例
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
-	// 读取编解码器构造函数
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
-		log.Println("rpc client - codec error:", err)
-		return nil, err
+	// 发送握手帧，并等待服务端确认协商后的 Option，服务端要求认证时使用 Credentials 回应质询
+	hs := &handshakeRequest{Option: opt}
+	if opt.Credentials != nil {
+		hs.AuthScheme = opt.Credentials.Scheme()
 	}
-
-	// RPC 客户端固定采用 JSON 编码协议交换信息 Option，并发送到 conn 中
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+	if err := writeHandshake(conn, hs); err != nil {
 		log.Println("rpc client - options error:", err)
 		// 关闭连接
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	ack, err := readAck(conn, opt.Credentials)
+	if err != nil {
+		log.Println("rpc client - handshake error:", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	negotiated := ack.Option
+	// 握手只协商需要传输的字段，只在本地使用的字段沿用客户端的 Option
+	negotiated.Interceptors = opt.Interceptors
+	negotiated.StreamWindow = opt.StreamWindow
+	negotiated.TLSConfig = opt.TLSConfig
+	negotiated.Credentials = opt.Credentials
+
+	// 根据协商后的编解码方式和压缩方式创建编解码器
+	cc, err := newCodec(conn, negotiated)
+	if err != nil {
+		log.Println("rpc client - codec error:", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	client := newClientCodec(cc, negotiated)
+	client.idempotent = ack.Idempotent
+	return client, nil
 
 }
 
@@ -93,6 +129,8 @@ func newClientCodec(cc codec.Codec, opt *Option) *Client {
 		cc: cc,
 		opt: opt,
 		pending: make(map[uint64]*Call),
+		handler: NewServer(),
+		unavailable: make(chan struct{}),
 	}
 
 	// 创建子协程调用 receive 方法接收响应
@@ -104,6 +142,9 @@ var _ io.Closer = (*Client)(nil)
 
 var ErrShutdown = errors.New("connection is shutdown")
 
+// 服务端正在关闭，不再接收新的请求
+var ErrGoingAway = errors.New("server is going away")
+
 // 关闭连接
 func (client *Client) Close() error {
 	client.mutex.Lock()
@@ -114,15 +155,61 @@ func (client *Client) Close() error {
 	}
 
 	client.closing = true
+	client.notifyUnavailable()
 	return client.cc.Close()
 }
 
+// 未完成的请求全部结束后关闭客户端，之后不能再发送新的请求
+// 用于丢弃服务端正在关闭的连接，已经发送的请求仍会收到响应；连接已经断开时立即关闭
+func (client *Client) CloseWhenIdle() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.closing {
+		return ErrShutdown
+	}
+	client.closeWhenIdle = true
+	client.notifyUnavailable()
+	client.closeIfIdle()
+	return nil
+}
+
 // 检查客户端是否可用
 func (client *Client) IsAvailable() bool {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
 
-	return !client.shutdown && !client.closing
+	return !client.shutdown && !client.closing && !client.goingAway && !client.closeWhenIdle
+}
+
+// 服务端是否将 serviceMethod 注册为幂等方法
+func (client *Client) IsIdempotent(serviceMethod string) bool {
+	for _, m := range client.idempotent {
+		if m == serviceMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查客户端能否发送新的请求，需要持有 client.mutex
+func (client *Client) checkAvailable() error {
+	if client.closing || client.shutdown || client.closeWhenIdle {
+		return ErrShutdown
+	}
+	if client.goingAway {
+		return ErrGoingAway
+	}
+	return nil
+}
+
+// 通知客户端已经不能发送新的请求，需要持有 client.mutex
+func (client *Client) notifyUnavailable() {
+	select {
+	case <- client.unavailable:
+	default:
+		close(client.unavailable)
+	}
 }
 
 // 将参数 call 添加到 client.pending 中，并更新 client.seq
@@ -130,8 +217,8 @@ func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
 
-	if client.closing || client.shutdown {
-		return 0, ErrShutdown
+	if err := client.checkAvailable(); err != nil {
+		return 0, err
 	}
 
 	// 为请求序列号赋值
@@ -153,6 +240,14 @@ func (client *Client) removeCall(seq uint64) *Call {
 	return call
 }
 
+// 设置了 closeWhenIdle 且没有未完成的请求时关闭客户端，需要持有 client.mutex
+func (client *Client) closeIfIdle() {
+	if client.closeWhenIdle && !client.closing && (client.shutdown || len(client.pending) == 0) {
+		client.closing = true
+		_ = client.cc.Close()
+	}
+}
+
 // 服务端或客户端发生错误时调用，将 shutdown 设置为 true，且将错误信息通知所有 pending 状态的 call
 func (client *Client) terminateCalls(err error) {
 	client.sendingMutex.Lock()
@@ -162,14 +257,29 @@ func (client *Client) terminateCalls(err error) {
 	defer client.mutex.Unlock()
 
 	client.shutdown = true
+	client.notifyUnavailable()
 	for _, call := range client.pending {
 		call.Error = err
 		call.done()
 	}
+	client.closeIfIdle()
+}
+
+// 注册本地服务，服务端可以通过连接对应的 Peer 回调其中的方法，方法的格式与 Server.Register 相同
+func (client *Client) Register(rcvr interface{}) error {
+	return client.handler.Register(rcvr)
 }
 
 // 客户端接收响应
 func (client *Client) receive() {
+	// 连接断开时取消正在处理的回调请求
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
 	var err error
 	for err == nil {
 		// 响应 header
@@ -178,8 +288,39 @@ func (client *Client) receive() {
 			break
 		}
 
+		if h.Type == codec.MsgGoAway {
+			// 服务端正在关闭，之后的调用直接返回 ErrGoingAway
+			client.mutex.Lock()
+			client.goingAway = true
+			client.notifyUnavailable()
+			client.mutex.Unlock()
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		if h.Type == codec.MsgStream {
+			// 流式调用的数据帧，请求仍未完成
+			err = client.receiveStream(&h)
+			continue
+		}
+		if h.Type == codec.MsgCallback {
+			// 服务端的回调请求
+			client.handleCallback(ctx, &h, wg)
+			continue
+		}
+		if h.Type == codec.MsgWindowUpdate {
+			// 双向流式调用中，服务端归还了发送窗口
+			if call := client.pendingCall(h.Seq); call != nil && call.stream != nil {
+				call.stream.updateWindow(h.Window)
+			}
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+
 		// 移除已响应完成的请求
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			call.Metadata = h.Metadata
+		}
 		switch {
 		case call == nil:
 			// 请求 call 不存在，可能是请求没有发送完整，或者因为其他原因被取消
@@ -188,21 +329,63 @@ func (client *Client) receive() {
 		case h.Error != "":
 			// 请求 call 存在，但服务端处理出错，h.Error 不为空
 			// 返回给 call 错误信息，并结束请求
-			call.Error = fmt.Errorf(h.Error)
+			call.Error = remoteError(&h)
 			err = client.cc.ReadBody(nil)
-			call.done()
 		default:
 			// 请求 call 存在，服务端正常处理，可以从 body 中读取 reply 值
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Error = errors.New("reading body " + err.Error())
+				call.Error = NewError(CodeCodec, "reading body " + err.Error())
 			}
+		}
+		if call != nil {
+			// 最后一个未完成的请求结束后关闭等待关闭的客户端
+			client.mutex.Lock()
+			client.closeIfIdle()
+			client.mutex.Unlock()
 			call.done()
 		}
 	}
 
-	// 接收请求出错，终止
-	client.terminateCalls(err)
+	// 接收请求出错，终止，未完成的请求可能已经被服务端处理
+	client.terminateCalls(&Error{Code: CodeUnavailable, Message: err.Error()})
+}
+
+// 使用本地服务处理服务端的回调请求，与服务端处理请求的方式相同，响应为 MsgCallbackReply
+func (client *Client) handleCallback(ctx context.Context, h *codec.Header, wg *sync.WaitGroup) {
+	req, err := client.handler.readRequestBody(client.cc, h)
+	req.h.Type = codec.MsgCallbackReply
+	if err != nil {
+		setHeaderError(req.h, err)
+		client.handler.sendResponse(client.cc, req.h, invalidRequest, &client.sendingMutex)
+		return
+	}
+
+	wg.Add(1)
+	go client.handler.handleRequest(ctx, client.cc, req, &client.sendingMutex, wg, 0)
+}
+
+// 返回 seq 对应的未完成的请求，不从 pending 中移除
+func (client *Client) pendingCall(seq uint64) *Call {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.pending[seq]
+}
+
+// 接收流式调用的一帧数据
+func (client *Client) receiveStream(h *codec.Header) error {
+	call := client.pendingCall(h.Seq)
+	if call == nil || call.stream == nil {
+		// 流已经被取消
+		return client.cc.ReadBody(nil)
+	}
+	item, body := newStreamItem(call.stream.itemType)
+	if err := client.cc.ReadBody(body); err != nil {
+		return err
+	}
+	call.stream.push(item())
+	return nil
 }
 
 // 处理用户传入的 option 信息
@@ -215,12 +398,13 @@ func parseOptions(opts ...*Option) (*Option, error) {
 		return nil, errors.New("number of options is more than 1")
 	}
 
-	opt := opts[0]
+	// 复制一份再补全默认值，不修改调用方的 Option，同一个 Option 可以被多个协程同时使用
+	opt := *opts[0]
 	opt.MagicNumber = DefaultOption.MagicNumber
 	if opt.CodecType == "" {
 		opt.CodecType = DefaultOption.CodecType
 	}
-	return opt, nil
+	return &opt, nil
 }
 
 // 用于处理客户端连接超时封装了客户端和超时错误信息
@@ -244,6 +428,10 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 	if err != nil {
 		return nil, err
 	}
+	if opt.TLSConfig != nil {
+		// TLS 握手在第一次读写时进行，同样受 ConnectTimeout 限制
+		conn = tls.Client(conn, clientTLSConfig(opt.TLSConfig, address))
+	}
 
 	// 如果新建客户端为 nil，关闭连接
 	// defer 语句执行在 return 语句赋值之后，方法结束之前
@@ -285,10 +473,15 @@ func (client *Client) send(call *Call) {
 	client.sendingMutex.Lock()
 	defer client.sendingMutex.Unlock()
 
+	client.writeCall(call)
+}
+
+// 注册并编码请求，调用方需要持有 sendingMutex
+func (client *Client) writeCall(call *Call) {
 	// 注册请求
 	seq, err := client.registerCall(call)
 	if err != nil {
-		call.Error = err
+		call.Error = &NotSentError{Err: err}
 		call.done()
 		return
 	}
@@ -297,33 +490,123 @@ func (client *Client) send(call *Call) {
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	// 将调用方剩余的超时时间传递给服务端
+	client.header.Timeout = remainingTimeout(call.ctx)
+	// 附加请求元数据
+	client.header.Metadata, _ = FromOutgoingContext(call.ctx)
+	client.header.Window = 0
+	if call.stream != nil {
+		// 流式调用携带接收方的初始窗口
+		client.header.Window = call.stream.window
+	}
 
 	// 编码并发送请求
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
 		call := client.removeCall(seq)
 
 		if call != nil {
-			call.Error = err
+			call.Error = &NotSentError{Err: err}
 			call.done()
 		}
 	}
 }
 
+// 发送请求之外的消息，例如控制消息和流式调用的数据帧
+func (client *Client) write(h *codec.Header, body interface{}) error {
+	client.sendingMutex.Lock()
+	defer client.sendingMutex.Unlock()
+
+	return client.cc.Write(h, body)
+}
+
+// 发送单向通知，服务端调用方法后不发送任何响应，客户端也不等待响应
+// 通知不占用序列号和 pending，返回 nil 只表示通知已经写入连接，方法的执行结果无法得知
+func (client *Client) Notify(serviceMethod string, args interface{}) error {
+	client.sendingMutex.Lock()
+	defer client.sendingMutex.Unlock()
+
+	client.mutex.Lock()
+	err := client.checkAvailable()
+	client.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	h := &codec.Header{ServiceMethod: serviceMethod, Type: codec.MsgNotify}
+	return client.cc.Write(h, args)
+}
+
+// ctx 剩余的超时时间，单位为纳秒，没有截止时间时为 0，已经超时时为 1，服务端收到后立即超时
+func remainingTimeout(ctx context.Context) int64 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if timeout := time.Until(deadline); timeout > 0 {
+		return int64(timeout)
+	}
+	return 1
+}
+
+// 通知服务端取消 seq 对应的请求
+func (client *Client) cancel(seq uint64) {
+	h := &codec.Header{Seq: seq, Type: codec.MsgCancel}
+	if err := client.write(h, invalidRequest); err != nil {
+		log.Println("rpc client - send cancel error:", err)
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.closeIfIdle()
+}
+
+// 通知服务端 seq 对应的流已经处理了 n 帧数据，可以继续发送
+func (client *Client) updateWindow(seq uint64, n uint32) {
+	h := &codec.Header{Seq: seq, Type: codec.MsgWindowUpdate, Window: n}
+	if err := client.write(h, invalidRequest); err != nil {
+		log.Println("rpc client - send window update error:", err)
+	}
+}
+
 // RPC 服务调用接口，是一个异步接口，返回 call 实例
+// 配置了拦截器时，拦截器链在新的协程中执行，结束后通过 done 返回 call
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	interceptors := client.interceptorChain()
+	if len(interceptors) == 0 {
+		return client.goContext(context.Background(), serviceMethod, args, reply, done)
+	}
+
+	call := newCall(context.Background(), serviceMethod, args, reply, done)
+	invoker := chainInvoker(interceptors, func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+		c := <- client.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1)).Done
+		call.Seq, call.Metadata = c.Seq, c.Metadata
+		return c.Error
+	})
+	go func() {
+		call.Error = invoker(call.ctx, serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+func newCall(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
 		log.Panic("rpc client - done channel is unbuffered")
 	}
 
-	call := &Call {
+	return &Call {
 		ServiceMethod: serviceMethod,
 		Args: args,
 		Reply: reply,
 		Done: done,
+		ctx: ctx,
 	}
+}
 
+func (client *Client) goContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	call := newCall(ctx, serviceMethod, args, reply, done)
 	client.send(call)
 	return call
 }
@@ -335,13 +618,28 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 // ctx, _ := context.WithTimeout(context.Background(), time.Second)
 // var reply int
 // err := client.Call(ctx, "Foo.Sum", &Args{1, 2}, &reply)
+// ctx 中通过 NewOutgoingContext 附加的元数据会随请求发送给服务端，
+// 通过 WithResponseMetadata 可以得到服务端返回的响应元数据
+// ctx 的截止时间会随请求发送给服务端，ctx 被取消时客户端会发送取消消息，服务端据此取消方法的 ctx
+// 配置了拦截器时，调用依次经过拦截器链
 func (client *Client) Call(ctx context.Context, serviceMethod string , args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	return chainInvoker(client.interceptorChain(), client.call)(ctx, serviceMethod, args, reply)
+}
+
+// 不经过拦截器直接发起调用
+func (client *Client) call(ctx context.Context, serviceMethod string , args, reply interface{}) error {
+	call := client.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1))
 	select {
 	case <- ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client - call failed: " + ctx.Err().Error())
+		// 请求仍未完成时，通知服务端取消处理
+		if client.removeCall(call.Seq) != nil {
+			client.cancel(call.Seq)
+		}
+		return contextError("rpc client - call failed", ctx.Err())
 	case call := <- call.Done:
+		if md, ok := ctx.Value(responseHolderKey{}).(*Metadata); ok {
+			*md = call.Metadata
+		}
 		return call.Error
 	}
 }
@@ -372,7 +670,7 @@ func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
 
 // 根据 RPCAddr 调用不同函数连接 RPC server
 // rpcAddr 格式： protocol@addr
-// http@10.0.0.1:7001, tcp@10.0.0.1:8001
+// http@10.0.0.1:7001, tcp@10.0.0.1:8001, tls@10.0.0.1:8443
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -384,6 +682,9 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	case "http":
 		// http 协议
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		// 基于 tcp 的 tls 协议
+		return DialTLS("tcp", addr, opts...)
 	default:
 		// tcp，unix 等协议
 		return Dial(protocol, addr, opts...)
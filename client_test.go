@@ -2,10 +2,16 @@ package violifer
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+	"violifer/codec"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // NewClient 函数耗时 2s，ConnectionTimeout 分别设置为 1s 和 0s 两种场景
@@ -37,6 +43,16 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+// 记录 Bar.Wait 的 ctx 被取消的原因
+var barCanceled = make(chan error, 1)
+
+// Bar.Wait 一直等待，直到 ctx 被取消
+func (b Bar) Wait(ctx context.Context, argv int, reply *int) error {
+	<-ctx.Done()
+	barCanceled <- ctx.Err()
+	return ctx.Err()
+}
+
 func startServer(addr chan string) {
 	var b Bar
 	_ = Register(&b)
@@ -54,10 +70,13 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
+		_assert(errors.Is(err, context.DeadlineExceeded) && CodeOf(err) == CodeDeadlineExceeded,
+			"expect the error to match context.DeadlineExceeded, got %v", err)
 	})
 	t.Run("server handle timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr, &Option{
@@ -66,5 +85,320 @@ func TestClient_Call(t *testing.T) {
 		var reply int
 		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+
+		err = client.Call(context.Background(), "Bar.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(<-barCanceled == context.DeadlineExceeded, "expect the handler context to be canceled on timeout")
+	})
+	t.Run("client cancel", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*200, cancel)
+		var reply int
+		err := client.Call(ctx, "Bar.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), context.Canceled.Error()), "expect a cancel error")
+		_assert(errors.Is(err, context.Canceled) && CodeOf(err) == CodeCanceled,
+			"expect the error to match context.Canceled, got %v", err)
+		_assert(<-barCanceled == context.Canceled, "expect the handler context to be canceled by the client")
 	})
-}
\ No newline at end of file
+	t.Run("client deadline", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+		var reply int
+		_ = client.Call(ctx, "Bar.Wait", 1, &reply)
+		_assert(<-barCanceled != nil, "expect the handler context to be done with the client deadline")
+	})
+}
+
+// 请求携带剩余的超时时间而不是截止时间，不受客户端和服务端时钟偏差的影响
+func TestClient_RemainingTimeout(t *testing.T) {
+	t.Parallel()
+	_assert(remainingTimeout(context.Background()) == 0, "expect no timeout without a deadline")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	timeout := remainingTimeout(ctx)
+	_assert(timeout > 0 && timeout <= int64(time.Second), "expect the remaining time, got %d", timeout)
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Hour))
+	defer cancelExpired()
+	_assert(remainingTimeout(expired) == 1, "expect an expired deadline to time out immediately")
+}
+
+type Baz int
+
+type BazArgs struct{ Num1, Num2 int }
+
+func (b Baz) Sum(args BazArgs, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (b Baz) Repeat(args BazArgs, reply *string) error {
+	*reply = strings.Repeat("violifer", args.Num1)
+	return nil
+}
+
+// 返回请求元数据中的 request-id，并设置响应元数据
+func (b Baz) RequestID(ctx context.Context, args BazArgs, reply *string) error {
+	md, _ := FromIncomingContext(ctx)
+	*reply = md["request-id"]
+	SetResponseMetadata(ctx, "server-timing", "1ms")
+	return nil
+}
+
+// 使用 JSON 编解码器调用，错误响应的 body 需要被正确丢弃
+func TestClient_JsonCodec(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Baz))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.JsonType})
+	_assert(err == nil, "dial with json codec failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Baz.Missing", &BazArgs{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method error")
+	err = client.Call(context.Background(), "Baz.Sum", &BazArgs{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Baz.Sum with json codec: %v", err)
+}
+
+type Counter int
+
+func (c Counter) Double(args *wrapperspb.Int64Value, reply *wrapperspb.Int64Value) error {
+	reply.Value = args.Value * 2
+	return nil
+}
+
+func (c Counter) Plain(args *wrapperspb.Int64Value, reply *int) error {
+	*reply = int(args.Value)
+	return nil
+}
+
+// 使用 protobuf 编解码器调用，返回值类型不是 proto.Message 时服务端返回明确的错误
+func TestClient_ProtobufCodec(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Counter))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.ProtobufType})
+	_assert(err == nil, "dial with protobuf codec failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var plain int
+	err = client.Call(context.Background(), "Counter.Plain", wrapperspb.Int64(3), &plain)
+	_assert(err != nil && strings.Contains(err.Error(), "does not implement proto.Message"), "expect a reply type error")
+
+	reply := new(wrapperspb.Int64Value)
+	err = client.Call(context.Background(), "Counter.Double", wrapperspb.Int64(3), reply)
+	_assert(err == nil && reply.Value == 6, "failed to call Counter.Double with protobuf codec: %v", err)
+}
+
+// 不同编解码方式与压缩方式组合，分别调用小于和大于压缩阈值的方法
+func TestClient_Compress(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Baz))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		for _, compressType := range []codec.CompressType{codec.CompressGzip, codec.CompressSnappy, codec.CompressZstd} {
+			client, err := Dial("tcp", l.Addr().String(), &Option{
+				CodecType:         codecType,
+				CompressType:      compressType,
+				CompressThreshold: 64,
+			})
+			_assert(err == nil, "dial with %s/%s failed: %v", codecType, compressType, err)
+
+			var sum int
+			err = client.Call(context.Background(), "Baz.Sum", &BazArgs{Num1: 1, Num2: 2}, &sum)
+			_assert(err == nil && sum == 3, "%s/%s: failed to call Baz.Sum: %v", codecType, compressType, err)
+			var repeat string
+			err = client.Call(context.Background(), "Baz.Repeat", &BazArgs{Num1: 1000}, &repeat)
+			_assert(err == nil && repeat == strings.Repeat("violifer", 1000),
+				"%s/%s: failed to call Baz.Repeat: %v", codecType, compressType, err)
+			err = client.Call(context.Background(), "Baz.Missing", &BazArgs{}, &sum)
+			_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "%s/%s: expect a method error", codecType, compressType)
+			_ = client.Close()
+		}
+	}
+
+	_, err := Dial("tcp", l.Addr().String(), &Option{CompressType: "lz4"})
+	_assert(err != nil && strings.Contains(err.Error(), "invalid compress type"), "expect a compress type error")
+}
+
+// 协议版本不一致时客户端得到 *VersionError，旧版本客户端的连接被直接关闭
+func TestClient_Handshake(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	t.Run("version mismatch", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		_ = writeBlock(conn, append(handshakeMagic[:], ProtocolVersion+1), DefaultOption)
+		_, err := readAck(conn, nil)
+		var verr *VersionError
+		_assert(errors.As(err, &verr) && verr.Server == ProtocolVersion, "expect a version error, got %v", err)
+	})
+	t.Run("legacy client", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		_ = json.NewEncoder(conn).Encode(DefaultOption)
+		_, err := conn.Read(make([]byte, 1))
+		_assert(err != nil, "expect the connection to be closed")
+	})
+}
+
+// 请求元数据通过 ctx 发送给服务端，响应元数据通过 Call.Metadata 和 WithResponseMetadata 返回
+func TestClient_Metadata(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Baz))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codecType})
+		_assert(err == nil, "dial with %s failed: %v", codecType, err)
+
+		var reply string
+		var md Metadata
+		ctx := NewOutgoingContext(context.Background(), Metadata{"request-id": "42"})
+		err = client.Call(WithResponseMetadata(ctx, &md), "Baz.RequestID", &BazArgs{}, &reply)
+		_assert(err == nil && reply == "42", "%s: expect request metadata on the server, got %q %v", codecType, reply, err)
+		_assert(md["server-timing"] == "1ms", "%s: expect response metadata, got %v", codecType, md)
+
+		call := <-client.Go("Baz.RequestID", &BazArgs{}, &reply, nil).Done
+		_assert(call.Error == nil && reply == "" && call.Metadata["server-timing"] == "1ms",
+			"%s: expect response metadata in Call, got %v", codecType, call.Metadata)
+		_ = client.Close()
+	}
+}
+
+// Option 中的拦截器先于 Client.Use 添加的拦截器执行，拦截器可以注入元数据或直接返回
+func TestClient_Use(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Baz))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	var order []string
+	inject := func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+		order = append(order, "inject")
+		return next(NewOutgoingContext(ctx, Metadata{"request-id": "7"}), serviceMethod, args, reply)
+	}
+	block := func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+		order = append(order, "block")
+		if serviceMethod == "Baz.Missing" {
+			return errors.New("blocked by interceptor")
+		}
+		return next(ctx, serviceMethod, args, reply)
+	}
+	client, _ := Dial("tcp", l.Addr().String(), &Option{Interceptors: []ClientInterceptor{inject}})
+	defer func() { _ = client.Close() }()
+	client.Use(block)
+
+	var reply string
+	err := client.Call(context.Background(), "Baz.RequestID", &BazArgs{}, &reply)
+	_assert(err == nil && reply == "7", "expect metadata injected by interceptor, got %q %v", reply, err)
+	call := <-client.Go("Baz.Missing", &BazArgs{}, &reply, nil).Done
+	_assert(call.Error != nil && call.Error.Error() == "blocked by interceptor", "expect the interceptor to block Go")
+	_assert(strings.Join(order, ",") == "inject,block,inject,block", "wrong interceptor order: %v", order)
+}
+
+type Audit struct {
+	events chan string
+}
+
+func (a *Audit) Record(args string, reply *struct{}) error {
+	a.events <- args
+	if args == "fail" {
+		return errors.New("record failed")
+	}
+	return nil
+}
+
+// 统计客户端读取的 header 数量
+type countingCodec struct {
+	codec.Codec
+	headers int64
+}
+
+func (c *countingCodec) ReadHeader(h *codec.Header) error {
+	err := c.Codec.ReadHeader(h)
+	if err == nil {
+		atomic.AddInt64(&c.headers, 1)
+	}
+	return err
+}
+
+// 单向通知不占用 pending，服务端执行方法后不发送任何响应，包括错误
+func TestClient_Notify(t *testing.T) {
+	t.Parallel()
+	audit := &Audit{events: make(chan string, 2)}
+	server := NewServer()
+	_ = server.Register(audit)
+	_ = server.Register(new(Baz))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	_ = writeHandshake(conn, &handshakeRequest{Option: DefaultOption})
+	ack, _ := readAck(conn, nil)
+	opt := ack.Option
+	cc, _ := newCodec(conn, opt)
+	counting := &countingCodec{Codec: cc}
+	client := newClientCodec(counting, opt)
+	defer func() { _ = client.Close() }()
+
+	_assert(client.Notify("Audit.Record", "login") == nil, "failed to notify")
+	_assert(client.Notify("Audit.Record", "fail") == nil, "failed to notify")
+	_assert(client.Notify("Audit.Missing", "") == nil, "failed to notify")
+	client.mutex.Lock()
+	_assert(len(client.pending) == 0 && client.seq == 1, "expect notifications to use no pending slot")
+	client.mutex.Unlock()
+	// 通知并发处理，顺序不确定
+	events := map[string]bool{<-audit.events: true, <-audit.events: true}
+	_assert(events["login"] && events["fail"], "expect the notifications to be handled, got %v", events)
+
+	var sum int
+	err := client.Call(context.Background(), "Baz.Sum", &BazArgs{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "failed to call Baz.Sum after notifications: %v", err)
+	time.Sleep(time.Millisecond * 100)
+	_assert(atomic.LoadInt64(&counting.headers) == 1, "expect only the reply of Call, got %d", counting.headers)
+
+	_ = client.Close()
+	_assert(client.Notify("Audit.Record", "logout") == ErrShutdown, "expect ErrShutdown after Close")
+}
+
+// CloseWhenIdle 之后不能发送新的请求，已经发出的请求完成后关闭客户端
+func TestClient_CloseWhenIdle(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Slow))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	var reply int
+	call := client.Go("Slow.Sleep", 200, &reply, nil)
+	time.Sleep(time.Millisecond * 50)
+
+	_assert(client.CloseWhenIdle() == nil, "failed to close when idle")
+	_assert(!client.IsAvailable(), "expect the client to be unavailable")
+	err := client.Call(context.Background(), "Slow.Sleep", 1, &reply)
+	_assert(errors.Is(err, ErrShutdown), "expect new calls to fail, got %v", err)
+	<-call.Done
+	_assert(call.Error == nil && reply == 200, "expect the in-flight call to complete: %v", call.Error)
+	_assert(client.Close() == ErrShutdown, "expect the client to be closed after the last call")
+}
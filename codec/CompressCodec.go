@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"fmt"
+	"log"
+)
+
+// 默认压缩阈值，编码后小于该长度的消息体不压缩
+const DefaultCompressThreshold = 1024
+
+/*
+对任意实现了 BodyMarshaler 的 Codec 进行包装，按消息压缩 body。
+body 先由被包装的 Codec 编码为字节，长度达到阈值时压缩并设置 Header.Compressed，
+之后以字节的形式交给被包装的 Codec 发送，对端根据 Header.Compressed 决定是否解压。
+错误响应和控制消息不发送 body。
+*/
+type CompressCodec struct {
+	Codec
+	bm         BodyMarshaler
+	compressor Compressor
+	threshold  int
+	// 最近读取的 header 中 body 是否被压缩
+	compressed bool
+}
+
+var _ Codec = (*CompressCodec)(nil)
+var _ BodyChecker = (*CompressCodec)(nil)
+var _ BatchWriter = (*CompressCodec)(nil)
+
+func NewCompressCodec(cc Codec, compressor Compressor, threshold int) (Codec, error) {
+	bm, ok := cc.(BodyMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("rpc codec - %T does not support compression", cc)
+	}
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	return &CompressCodec{
+		Codec:      cc,
+		bm:         bm,
+		compressor: compressor,
+		threshold:  threshold,
+	}, nil
+}
+
+func (c *CompressCodec) ReadHeader(h *Header) error {
+	if err := c.Codec.ReadHeader(h); err != nil {
+		return err
+	}
+	c.compressed = h.Compressed
+	return nil
+}
+
+func (c *CompressCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return c.Codec.ReadBody(nil)
+	}
+
+	var data []byte
+	if err := c.Codec.ReadBody(&data); err != nil {
+		return err
+	}
+	if c.compressed {
+		var err error
+		if data, err = c.compressor.Decompress(data); err != nil {
+			return err
+		}
+	}
+	return c.bm.UnmarshalBody(data, body)
+}
+
+func (c *CompressCodec) Write(h *Header, body interface{}) error {
+	var data []byte
+	h.Compressed = false
+	if !h.emptyBody() {
+		var err error
+		if data, err = c.bm.MarshalBody(body); err != nil {
+			log.Println("rpc codec: error encoding body:", err)
+			return err
+		}
+		if len(data) >= c.threshold {
+			if data, err = c.compressor.Compress(data); err != nil {
+				log.Println("rpc codec: error compressing body:", err)
+				return err
+			}
+			h.Compressed = true
+		}
+	}
+	return c.Codec.Write(h, data)
+}
+
+// 被包装的 Codec 对消息体类型有要求时，由它检查
+func (c *CompressCodec) CheckBody(body interface{}) error {
+	if bc, ok := c.Codec.(BodyChecker); ok {
+		return bc.CheckBody(body)
+	}
+	return nil
+}
+
+// 被包装的 Codec 支持暂停刷新时，由它处理
+func (c *CompressCodec) Hold() {
+	if bw, ok := c.Codec.(BatchWriter); ok {
+		bw.Hold()
+	}
+}
+
+func (c *CompressCodec) Flush() error {
+	if bw, ok := c.Codec.(BatchWriter); ok {
+		return bw.Flush()
+	}
+	return nil
+}
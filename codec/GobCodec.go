@@ -2,6 +2,7 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
 	"log"
@@ -13,6 +14,8 @@ type GobCodec struct {
 	conn io.ReadWriteCloser
 	// 使用带缓冲 Writer 提升性能
 	buf *bufio.Writer
+	// 为 true 时 Write 只写入缓冲，直到调用 Flush
+	held bool
 	// gob 解码
 	dec *gob.Decoder
 	// gob 编码
@@ -20,6 +23,8 @@ type GobCodec struct {
 }
 
 var _ Codec = (*GobCodec)(nil)
+var _ BatchWriter = (*GobCodec)(nil)
+var _ BodyMarshaler = (*GobCodec)(nil)
 
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
 	// 创建一个具有默认大小缓冲、写入 conn 的 *Writer
@@ -46,7 +51,9 @@ func (c *GobCodec) ReadBody(body interface{}) error {
 func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
 	defer func() {
 		// 将缓冲中的数据写入下层的 io.Writer 接口
-		_ = c.buf.Flush()
+		if !c.held {
+			_ = c.buf.Flush()
+		}
 		if err != nil {
 			_ = c.Close()
 		}
@@ -65,6 +72,28 @@ func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
 	return
 }
 
+// 使用独立的 gob 编码器编码 body，得到的字节包含完整的类型信息
+func (c *GobCodec) MarshalBody(body interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *GobCodec) UnmarshalBody(data []byte, body interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(body)
+}
+
+func (c *GobCodec) Hold() {
+	c.held = true
+}
+
+func (c *GobCodec) Flush() error {
+	c.held = false
+	return c.buf.Flush()
+}
+
 // 关闭连接
 func (c *GobCodec) Close() error {
 	return c.conn.Close()
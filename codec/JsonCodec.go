@@ -0,0 +1,94 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// json 编解码并读写方式，实现 Codec 接口
+// 报文为连续的 JSON 值：| Header1 | Body1 | Header2 | Body2 | ...
+type JsonCodec struct {
+	// TCP 或者 Unix 建立 socket 时得到的链接实例
+	conn io.ReadWriteCloser
+	// 使用带缓冲 Writer 提升性能
+	buf *bufio.Writer
+	// 为 true 时 Write 只写入缓冲，直到调用 Flush
+	held bool
+	// json 解码
+	dec *json.Decoder
+	// json 编码
+	enc *json.Encoder
+}
+
+var _ Codec = (*JsonCodec)(nil)
+var _ BatchWriter = (*JsonCodec)(nil)
+var _ BodyMarshaler = (*JsonCodec)(nil)
+
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+
+	return &JsonCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(buf),
+	}
+}
+
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	return c.dec.Decode(h)
+}
+
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		// body 为 nil 时需要丢弃下一个 JSON 值，否则后续的 header 会错位
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		if !c.held {
+			_ = c.buf.Flush()
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: json error encoding header:", err)
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		log.Println("rpc codec: json error encoding body:", err)
+		return err
+	}
+	return
+}
+
+func (c *JsonCodec) MarshalBody(body interface{}) ([]byte, error) {
+	return json.Marshal(body)
+}
+
+func (c *JsonCodec) UnmarshalBody(data []byte, body interface{}) error {
+	return json.Unmarshal(data, body)
+}
+
+func (c *JsonCodec) Hold() {
+	c.held = true
+}
+
+func (c *JsonCodec) Flush() error {
+	c.held = false
+	return c.buf.Flush()
+}
+
+// 关闭连接
+func (c *JsonCodec) Close() error {
+	return c.conn.Close()
+}
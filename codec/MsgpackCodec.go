@@ -0,0 +1,198 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+MessagePack 编解码方式，便于 Python、Node 等其他语言的客户端接入。
+
+每个 header 和 body 各占一帧，帧由 4 字节大端序长度前缀和一个完整的 MessagePack 值组成：
+| uint32 len | Header | uint32 len | Body | uint32 len | Header | uint32 len | Body | ...
+
+header 编码为以字段名为键的 map，整数使用最紧凑的格式，例如：
+{"ServiceMethod": "Foo.Sum", "Seq": 1, "Error": ""}
+body 为任意 MessagePack 值，结构体编码为以字段名为键的 map，服务端返回错误时 body 为空 map。
+testdata/msgpack 目录下的 golden 文件是标准的报文示例，其他语言的客户端可以用来验证兼容性。
+*/
+type MsgpackCodec struct {
+	// TCP 或者 Unix 建立 socket 时得到的链接实例
+	conn io.ReadWriteCloser
+	// 带缓冲的 Reader，用于读取长度前缀
+	r *bufio.Reader
+	// 使用带缓冲 Writer 提升性能
+	buf *bufio.Writer
+	// 为 true 时 Write 只写入缓冲，直到调用 Flush
+	held bool
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+var _ BatchWriter = (*MsgpackCodec)(nil)
+var _ BodyMarshaler = (*MsgpackCodec)(nil)
+
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	return &MsgpackCodec{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		buf:  bufio.NewWriter(conn),
+	}
+}
+
+// header 在 MessagePack 中的结构，键名是协议的一部分，不能随意修改
+type msgpackHeader struct {
+	ServiceMethod string            `msgpack:"ServiceMethod"`
+	Seq           uint64            `msgpack:"Seq"`
+	Error         string            `msgpack:"Error"`
+	Compressed    bool              `msgpack:"Compressed,omitempty"`
+	Timeout       int64             `msgpack:"Timeout,omitempty"`
+	Type          uint8             `msgpack:"Type,omitempty"`
+	Metadata      map[string]string `msgpack:"Metadata,omitempty"`
+	Window        uint32            `msgpack:"Window,omitempty"`
+	ErrorCode     uint32            `msgpack:"ErrorCode,omitempty"`
+	ErrorDetails  []string          `msgpack:"ErrorDetails,omitempty"`
+}
+
+// 单帧最大长度，防止异常的长度前缀导致分配过多内存
+const maxMsgpackFrame = 64 << 20
+
+// 读取一帧数据
+func (c *MsgpackCodec) readFrame() ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(c.r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > maxMsgpackFrame {
+		return nil, fmt.Errorf("rpc codec - msgpack frame too large: %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 将 v 编码后作为一帧写入
+func (c *MsgpackCodec) writeFrame(v interface{}) error {
+	data, err := marshalMsgpack(v)
+	if err != nil {
+		return err
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(data)))
+	if _, err := c.buf.Write(l[:]); err != nil {
+		return err
+	}
+	_, err = c.buf.Write(data)
+	return err
+}
+
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	var mh msgpackHeader
+	if err := msgpack.Unmarshal(data, &mh); err != nil {
+		return err
+	}
+	*h = Header{
+		ServiceMethod: mh.ServiceMethod,
+		Seq:           mh.Seq,
+		Error:         mh.Error,
+		Compressed:    mh.Compressed,
+		Timeout:       mh.Timeout,
+		Type:          MsgType(mh.Type),
+		Metadata:      mh.Metadata,
+		Window:        mh.Window,
+		ErrorCode:     mh.ErrorCode,
+		ErrorDetails:  mh.ErrorDetails,
+	}
+	return nil
+}
+
+func (c *MsgpackCodec) ReadBody(body interface{}) error {
+	data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		// body 为 nil 时丢弃这一帧
+		return nil
+	}
+	return msgpack.Unmarshal(data, body)
+}
+
+func (c *MsgpackCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		if !c.held {
+			_ = c.buf.Flush()
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	mh := &msgpackHeader{
+		ServiceMethod: h.ServiceMethod,
+		Seq:           h.Seq,
+		Error:         h.Error,
+		Compressed:    h.Compressed,
+		Timeout:       h.Timeout,
+		Type:          uint8(h.Type),
+		Metadata:      h.Metadata,
+		Window:        h.Window,
+		ErrorCode:     h.ErrorCode,
+		ErrorDetails:  h.ErrorDetails,
+	}
+	if err := c.writeFrame(mh); err != nil {
+		log.Println("rpc codec: msgpack error encoding header:", err)
+		return err
+	}
+	if err := c.writeFrame(body); err != nil {
+		log.Println("rpc codec: msgpack error encoding body:", err)
+		return err
+	}
+	return
+}
+
+func (c *MsgpackCodec) MarshalBody(body interface{}) ([]byte, error) {
+	return marshalMsgpack(body)
+}
+
+func (c *MsgpackCodec) UnmarshalBody(data []byte, body interface{}) error {
+	return msgpack.Unmarshal(data, body)
+}
+
+func (c *MsgpackCodec) Hold() {
+	c.held = true
+}
+
+func (c *MsgpackCodec) Flush() error {
+	c.held = false
+	return c.buf.Flush()
+}
+
+// 关闭连接
+func (c *MsgpackCodec) Close() error {
+	return c.conn.Close()
+}
+
+// 使用紧凑的整数格式和有序的 map 键编码，保证相同的值总是得到相同的字节
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.UseCompactInts(true)
+	enc.SetSortMapKeys(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
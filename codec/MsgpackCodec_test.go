@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// go test ./codec -update 重新生成 golden 文件
+var update = flag.Bool("update", false, "update golden files")
+
+// 内存中的连接，写入 w，从 r 读取
+type bufferConn struct {
+	r io.Reader
+	w *bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *bufferConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *bufferConn) Close() error                { return nil }
+
+type sumArgs struct {
+	Num1 int
+	Num2 int
+}
+
+// 跨语言的兼容性测试用例，每个用例对应 testdata/msgpack 下的一个 golden 文件
+var msgpackVectors = []struct {
+	name   string
+	header Header
+	body   interface{}
+	// 解码 body 使用的值
+	newBody func() interface{}
+}{
+	{
+		name:    "request",
+		header:  Header{ServiceMethod: "Foo.Sum", Seq: 1},
+		body:    &sumArgs{Num1: 1, Num2: 2},
+		newBody: func() interface{} { return new(sumArgs) },
+	},
+	{
+		name:    "response",
+		header:  Header{ServiceMethod: "Foo.Sum", Seq: 1},
+		body:    3,
+		newBody: func() interface{} { return new(int) },
+	},
+	{
+		name:    "error",
+		header:  Header{ServiceMethod: "Foo.Missing", Seq: 2, Error: "rpc server - can't find method: Missing"},
+		body:    struct{}{},
+		newBody: func() interface{} { return new(struct{}) },
+	},
+	{
+		name: "coded_error",
+		header: Header{ServiceMethod: "Foo.Sum", Seq: 3, Error: "num1 must be positive",
+			ErrorCode: 2, ErrorDetails: []string{"field=Num1"}},
+		body:    struct{}{},
+		newBody: func() interface{} { return new(struct{}) },
+	},
+}
+
+func TestMsgpackCodec_Golden(t *testing.T) {
+	for _, v := range msgpackVectors {
+		t.Run(v.name, func(t *testing.T) {
+			golden := filepath.Join("testdata", "msgpack", v.name+".golden")
+
+			var w bytes.Buffer
+			h := v.header
+			if err := NewMsgpackCodec(&bufferConn{r: &bytes.Buffer{}, w: &w}).Write(&h, v.body); err != nil {
+				t.Fatalf("write %s: %v", v.name, err)
+			}
+			if *update {
+				if err := os.WriteFile(golden, w.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(w.Bytes(), want) {
+				t.Fatalf("encoded %s mismatch golden file\n got: %x\nwant: %x", v.name, w.Bytes(), want)
+			}
+
+			// 解码 golden 文件，并在之后追加一份报文，验证 ReadBody(nil) 能够正确丢弃 body
+			cc := NewMsgpackCodec(&bufferConn{r: bytes.NewReader(append(append([]byte{}, want...), want...))})
+			var got Header
+			if err := cc.ReadHeader(&got); err != nil || !reflect.DeepEqual(got, v.header) {
+				t.Fatalf("decode header: %v, got %+v", err, got)
+			}
+			if err := cc.ReadBody(nil); err != nil {
+				t.Fatalf("discard body: %v", err)
+			}
+			if err := cc.ReadHeader(&got); err != nil || !reflect.DeepEqual(got, v.header) {
+				t.Fatalf("decode header after discard: %v, got %+v", err, got)
+			}
+			body := v.newBody()
+			if err := cc.ReadBody(body); err != nil {
+				t.Fatalf("decode body: %v", err)
+			}
+			if !reflect.DeepEqual(reflect.ValueOf(body).Elem().Interface(), reflect.Indirect(reflect.ValueOf(v.body)).Interface()) {
+				t.Fatalf("decode body: got %+v, want %+v", body, v.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+protobuf 编解码方式，每个 header 和 body 各占一帧，帧由 uvarint 长度前缀和 protobuf 数据组成：
+| len | Header | len | Body | len | Header | len | Body | ...
+
+header 固定编码为如下 protobuf 消息：
+message Header {
+	string service_method = 1;
+	uint64 seq = 2;
+	string error = 3;
+	bool compressed = 4;
+	int64 timeout = 5;
+	uint32 type = 6;
+	map<string, string> metadata = 7;
+	uint32 window = 8;
+	uint32 error_code = 9;
+	repeated string error_details = 10;
+}
+body 必须实现 proto.Message，错误响应和控制消息的 body 为空帧。
+body 为 []byte 时视为已经编码的数据，直接作为一帧写入，读取时使用 *[]byte 得到原始数据
+*/
+type ProtobufCodec struct {
+	// TCP 或者 Unix 建立 socket 时得到的链接实例
+	conn io.ReadWriteCloser
+	// 带缓冲的 Reader，用于读取长度前缀
+	r *bufio.Reader
+	// 使用带缓冲 Writer 提升性能
+	buf *bufio.Writer
+	// 为 true 时 Write 只写入缓冲，直到调用 Flush
+	held bool
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+var _ BatchWriter = (*ProtobufCodec)(nil)
+var _ BodyChecker = (*ProtobufCodec)(nil)
+var _ BodyMarshaler = (*ProtobufCodec)(nil)
+
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		buf:  bufio.NewWriter(conn),
+	}
+}
+
+// header 中各字段的编号
+const (
+	pbServiceMethod protowire.Number = 1
+	pbSeq           protowire.Number = 2
+	pbError         protowire.Number = 3
+	pbCompressed    protowire.Number = 4
+	pbTimeout       protowire.Number = 5
+	pbType          protowire.Number = 6
+	pbMetadata      protowire.Number = 7
+	pbWindow        protowire.Number = 8
+	pbErrorCode     protowire.Number = 9
+	pbErrorDetails  protowire.Number = 10
+)
+
+// 单帧最大长度，防止异常的长度前缀导致分配过多内存
+const maxProtobufFrame = 64 << 20
+
+// 读取一帧数据
+func (c *ProtobufCodec) readFrame() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxProtobufFrame {
+		return nil, fmt.Errorf("rpc codec - protobuf frame too large: %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 写入一帧数据
+func (c *ProtobufCodec) writeFrame(data []byte) error {
+	if _, err := c.buf.Write(protowire.AppendVarint(nil, uint64(len(data)))); err != nil {
+		return err
+	}
+	_, err := c.buf.Write(data)
+	return err
+}
+
+func (c *ProtobufCodec) ReadHeader(h *Header) error {
+	data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	return unmarshalProtobufHeader(data, h)
+}
+
+func (c *ProtobufCodec) ReadBody(body interface{}) error {
+	// 先读取完整的一帧，即使类型不匹配，也不会影响后续报文的解析
+	data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	if raw, ok := body.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	return c.UnmarshalBody(data, body)
+}
+
+func (c *ProtobufCodec) Write(h *Header, body interface{}) (err error) {
+	var data []byte
+	if raw, ok := body.([]byte); ok {
+		data = raw
+	} else if m, ok := body.(proto.Message); ok {
+		if data, err = proto.Marshal(m); err != nil {
+			log.Println("rpc codec: protobuf error encoding body:", err)
+			return err
+		}
+	} else if !h.emptyBody() {
+		// 类型错误在写入之前就能发现，连接仍然可用，不需要关闭
+		return c.CheckBody(body)
+	}
+
+	defer func() {
+		if !c.held {
+			_ = c.buf.Flush()
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	if err := c.writeFrame(marshalProtobufHeader(h)); err != nil {
+		log.Println("rpc codec: protobuf error encoding header:", err)
+		return err
+	}
+	if err := c.writeFrame(data); err != nil {
+		log.Println("rpc codec: protobuf error encoding body:", err)
+		return err
+	}
+	return
+}
+
+// 检查 body 是否实现了 proto.Message
+func (c *ProtobufCodec) CheckBody(body interface{}) error {
+	if _, ok := body.(proto.Message); !ok {
+		return fmt.Errorf("rpc codec - protobuf: type %T does not implement proto.Message", body)
+	}
+	return nil
+}
+
+func (c *ProtobufCodec) MarshalBody(body interface{}) ([]byte, error) {
+	if err := c.CheckBody(body); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(body.(proto.Message))
+}
+
+func (c *ProtobufCodec) UnmarshalBody(data []byte, body interface{}) error {
+	if err := c.CheckBody(body); err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, body.(proto.Message))
+}
+
+func (c *ProtobufCodec) Hold() {
+	c.held = true
+}
+
+func (c *ProtobufCodec) Flush() error {
+	c.held = false
+	return c.buf.Flush()
+}
+
+// 关闭连接
+func (c *ProtobufCodec) Close() error {
+	return c.conn.Close()
+}
+
+// 将 header 编码为 protobuf 消息
+func marshalProtobufHeader(h *Header) []byte {
+	var b []byte
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, pbServiceMethod, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, pbSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, pbError, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	if h.Compressed {
+		b = protowire.AppendTag(b, pbCompressed, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, pbTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	if h.Type != MsgCall {
+		b = protowire.AppendTag(b, pbType, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Type))
+	}
+	// map 编码为重复的键值对消息，按键排序保证编码结果稳定
+	keys := make([]string, 0, len(h.Metadata))
+	for k := range h.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, h.Metadata[k])
+		b = protowire.AppendTag(b, pbMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if h.Window != 0 {
+		b = protowire.AppendTag(b, pbWindow, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Window))
+	}
+	if h.ErrorCode != 0 {
+		b = protowire.AppendTag(b, pbErrorCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.ErrorCode))
+	}
+	for _, detail := range h.ErrorDetails {
+		b = protowire.AppendTag(b, pbErrorDetails, protowire.BytesType)
+		b = protowire.AppendString(b, detail)
+	}
+	return b
+}
+
+// 将 protobuf 消息解码为 header，未知字段会被跳过
+func unmarshalProtobufHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == pbServiceMethod && typ == protowire.BytesType:
+			h.ServiceMethod, n = protowire.ConsumeString(b)
+		case num == pbSeq && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == pbError && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == pbCompressed && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Compressed = protowire.DecodeBool(v)
+		case num == pbTimeout && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = int64(v)
+		case num == pbType && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Type = MsgType(v)
+		case num == pbMetadata && typ == protowire.BytesType:
+			var entry []byte
+			entry, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				if err := unmarshalProtobufMetadata(entry, h); err != nil {
+					return err
+				}
+			}
+		case num == pbWindow && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Window = uint32(v)
+		case num == pbErrorCode && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.ErrorCode = uint32(v)
+		case num == pbErrorDetails && typ == protowire.BytesType:
+			var detail string
+			detail, n = protowire.ConsumeString(b)
+			h.ErrorDetails = append(h.ErrorDetails, detail)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// 解码一个元数据键值对
+func unmarshalProtobufMetadata(b []byte, h *Header) error {
+	var key, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	if h.Metadata == nil {
+		h.Metadata = make(map[string]string)
+	}
+	h.Metadata[key] = value
+	return nil
+}
@@ -17,6 +17,58 @@ type Header struct {
 	Seq uint64
 	// 服务端出错后返回的错误信息
 	Error string
+	// body 是否被压缩
+	Compressed bool
+	// 调用方剩余的超时时间，单位为纳秒，0 表示不设限
+	// 使用相对时间而不是截止时间，避免客户端和服务端的时钟偏差影响超时
+	Timeout int64
+	// 消息类型，默认为普通的请求或响应
+	Type MsgType
+	// 请求或响应携带的元数据
+	Metadata map[string]string
+	// 流控窗口，发起流式调用时为接收方的初始窗口，MsgWindowUpdate 中为窗口增量，单位为帧
+	Window uint32
+	// 错误码，Error 不为空时有效，0 表示服务端没有提供错误码
+	ErrorCode uint32
+	// 错误的附加信息
+	ErrorDetails []string
+}
+
+// 消息类型
+type MsgType uint8
+
+const (
+	// 普通的请求或响应
+	MsgCall MsgType = iota
+	// 客户端取消 Seq 对应的请求，body 为空
+	MsgCancel
+	// 服务端正在关闭，客户端不应再发送新的请求，body 为空
+	MsgGoAway
+	// 流式调用中的一帧数据，同一个流的所有帧使用相同的 Seq
+	MsgStream
+	// 流式调用结束，Error 不为空时表示流以错误结束，body 为空
+	MsgStreamEnd
+	// 接收方已经处理了 Window 帧数据，发送方可以继续发送，body 为空；
+	// 服务端流开始时服务端发送 Window 为 0 的 MsgWindowUpdate，表示不接收客户端的数据
+	MsgWindowUpdate
+	// 单向通知，body 为请求参数，服务端不发送任何响应，Seq 为 0
+	MsgNotify
+	// 服务端调用客户端注册的服务，body 为请求参数，Seq 由服务端分配
+	MsgCallback
+	// 客户端对回调请求的响应，body 为返回值
+	MsgCallbackReply
+)
+
+// body 是否为空，错误响应和控制消息只发送空的 body
+func (h *Header) emptyBody() bool {
+	if h.Error != "" {
+		return true
+	}
+	switch h.Type {
+	case MsgCall, MsgStream, MsgNotify, MsgCallback, MsgCallbackReply:
+		return false
+	}
+	return true
 }
 
 // 对消息体进行编解码并读写的接口，抽象出来可以实现不同的 Codec
@@ -27,6 +79,26 @@ type Codec interface {
 	io.Closer
 }
 
+// 对消息体类型有要求的 Codec 可以实现该接口，服务端在调用方法之前检查参数和返回值类型
+type BodyChecker interface {
+	CheckBody(interface{}) error
+}
+
+// 能够将消息体单独编解码为字节的 Codec 可以实现该接口，压缩等需要处理消息体字节的包装依赖它
+type BodyMarshaler interface {
+	MarshalBody(interface{}) ([]byte, error)
+	UnmarshalBody([]byte, interface{}) error
+}
+
+// 能够暂停刷新写缓冲的 Codec 可以实现该接口，连续发送多条消息时只刷新一次，减少系统调用
+// Hold 和 Flush 与 Write 一样，需要调用方保证不会并发调用
+type BatchWriter interface {
+	// 之后的 Write 只写入缓冲，不刷新
+	Hold()
+	// 刷新缓冲，之后的 Write 恢复为每次写入后刷新
+	Flush() error
+}
+
 // 抽象出 Codec 的构造函数，客户端和服务端可以通过 Codec 的 Type 得到构造函数，从而创建 Codec 实例
 type NewCodecFunc func(closer io.ReadWriteCloser) Codec
 
@@ -36,6 +108,8 @@ type Type string
 const (
 	GobType Type = "application/gob"
 	JsonType Type = "application/json"
+	ProtobufType Type = "application/protobuf"
+	MsgpackType Type = "application/msgpack"
 )
 
 // 编码类型与构造函数映射关系 map
@@ -45,4 +119,10 @@ func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	// gob 编码与相关构造函数映射
 	NewCodecFuncMap[GobType] = NewGobCodec
+	// json 编码与相关构造函数映射
+	NewCodecFuncMap[JsonType] = NewJsonCodec
+	// protobuf 编码与相关构造函数映射
+	NewCodecFuncMap[ProtobufType] = NewProtobufCodec
+	// msgpack 编码与相关构造函数映射
+	NewCodecFuncMap[MsgpackType] = NewMsgpackCodec
 }
\ No newline at end of file
@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩方式
+type CompressType string
+
+const (
+	// 不压缩
+	CompressNone   CompressType = ""
+	CompressGzip   CompressType = "gzip"
+	CompressSnappy CompressType = "snappy"
+	CompressZstd   CompressType = "zstd"
+)
+
+// 消息体的压缩与解压缩接口，实现需要支持并发调用
+type Compressor interface {
+	Compress([]byte) ([]byte, error)
+	Decompress([]byte) ([]byte, error)
+}
+
+// 压缩方式与压缩器映射关系 map
+var CompressorMap = map[CompressType]Compressor{
+	CompressGzip:   gzipCompressor{},
+	CompressSnappy: snappyCompressor{},
+	CompressZstd:   newZstdCompressor(),
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return io.ReadAll(r)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// zstd 的 Encoder 和 Decoder 创建开销较大，EncodeAll 和 DecodeAll 可以并发调用，因此共用同一个实例
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	enc, _ := zstd.NewWriter(nil)
+	dec, _ := zstd.NewReader(nil)
+	return &zstdCompressor{enc: enc, dec: dec}
+}
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	return c.dec.DecodeAll(data, nil)
+}
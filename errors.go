@@ -0,0 +1,150 @@
+package violifer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"violifer/codec"
+)
+
+// 错误码
+// 服务端的错误通过 Header.Error、Header.ErrorCode 和 Header.ErrorDetails 发送给客户端，客户端得到 *Error，
+// 可以通过 errors.As 得到错误码和附加信息，也可以通过 errors.Is 判断错误码，例如：
+// errors.Is(err, &Error{Code: CodeNotFound})
+// 服务方法和拦截器返回 *Error 即可指定错误码，返回其他错误时错误码为 CodeUnknown
+
+// 错误码，数值是协议的一部分，不能随意修改
+type Code uint32
+
+const (
+	CodeOK Code = 0
+	// 服务方法返回的普通错误，或者服务端没有提供错误码
+	CodeUnknown Code = 1
+	// 请求不合法，例如 ServiceMethod 格式错误、调用方式与方法类型不一致
+	CodeInvalidArgument Code = 2
+	// 服务或方法不存在
+	CodeNotFound Code = 3
+	// 处理超时
+	CodeDeadlineExceeded Code = 4
+	// 请求被取消
+	CodeCanceled Code = 5
+	// 服务端正在关闭
+	CodeUnavailable Code = 6
+	// 服务端内部错误，例如服务方法 panic
+	CodeInternal Code = 7
+	// 请求参数或返回值编解码失败
+	CodeCodec Code = 8
+	// 没有权限调用服务方法
+	CodePermissionDenied Code = 9
+	// 客户端没有通过认证
+	CodeUnauthenticated Code = 10
+)
+
+var codeNames = map[Code]string{
+	CodeOK: "ok",
+	CodeUnknown: "unknown",
+	CodeInvalidArgument: "invalid argument",
+	CodeNotFound: "not found",
+	CodeDeadlineExceeded: "deadline exceeded",
+	CodeCanceled: "canceled",
+	CodeUnavailable: "unavailable",
+	CodeInternal: "internal",
+	CodeCodec: "codec",
+	CodePermissionDenied: "permission denied",
+	CodeUnauthenticated: "unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code(%d)", uint32(c))
+}
+
+// 带有错误码的 RPC 错误
+type Error struct {
+	Code Code
+	Message string
+	// 附加信息，例如不合法的字段
+	Details []string
+	// 引起错误的原因，例如 ctx.Err()，不会发送给对方
+	err error
+}
+
+// 创建带有错误码的错误
+func NewError(code Code, msg string, details ...string) *Error {
+	return &Error{Code: code, Message: msg, Details: details}
+}
+
+// 创建带有错误码的错误，错误信息由 format 格式化得到
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// 错误码相同即视为相同的错误
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// ctx 结束导致的错误，错误码为 CodeDeadlineExceeded 或 CodeCanceled，errors.Is 可以匹配 ctx.Err()
+func contextError(msg string, err error) error {
+	code := CodeCanceled
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = CodeDeadlineExceeded
+	}
+	return &Error{Code: code, Message: msg + ": " + err.Error(), err: err}
+}
+
+// 返回 err 的错误码，nil 返回 CodeOK，不是 *Error 时返回 CodeUnknown
+func CodeOf(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeUnknown
+}
+
+// 请求没有发送到服务端，例如连接不可用、建立连接失败、写入失败，非幂等的请求也可以安全地重试
+type NotSentError struct {
+	Err error
+}
+
+func (e *NotSentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NotSentError) Unwrap() error {
+	return e.Err
+}
+
+// 将错误写入响应的 header
+func setHeaderError(h *codec.Header, err error) {
+	h.Error = err.Error()
+	h.ErrorCode = uint32(CodeOf(err))
+	h.ErrorDetails = nil
+	var e *Error
+	if errors.As(err, &e) {
+		h.ErrorDetails = e.Details
+	}
+}
+
+// 将服务端返回的错误转换为 *Error，服务端没有提供错误码时为 CodeUnknown
+func remoteError(h *codec.Header) error {
+	code := Code(h.ErrorCode)
+	if code == CodeOK {
+		code = CodeUnknown
+	}
+	return &Error{Code: code, Message: h.Error, Details: h.ErrorDetails}
+}
@@ -0,0 +1,100 @@
+package violifer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+	"violifer/codec"
+)
+
+type Validator int
+
+// 参数不合法时返回带有错误码和附加信息的错误
+func (v Validator) Check(args BazArgs, reply *int) error {
+	if args.Num1 < 0 {
+		return NewError(CodeInvalidArgument, "num1 must not be negative", "field=Num1")
+	}
+	if args.Num2 < 0 {
+		return errors.New("num2 must not be negative")
+	}
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// 服务方法返回的错误码、内置错误的错误码都能通过 errors.Is 和 errors.As 判断
+func TestError_Code(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Validator))
+	_ = server.Register(new(Slow))
+	_ = server.Register(new(Boom))
+	server.SetLogger(new(bufferLogger))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codecType, HandleTimeout: time.Millisecond * 100})
+		_assert(err == nil, "%s: failed to dial: %v", codecType, err)
+		var reply int
+
+		err = client.Call(context.Background(), "Validator.Check", &BazArgs{Num1: -1}, &reply)
+		var rerr *Error
+		_assert(errors.As(err, &rerr), "%s: expect *Error, got %T", codecType, err)
+		_assert(rerr.Code == CodeInvalidArgument && rerr.Message == "num1 must not be negative" &&
+			len(rerr.Details) == 1 && rerr.Details[0] == "field=Num1", "%s: unexpected error %+v", codecType, rerr)
+		_assert(errors.Is(err, &Error{Code: CodeInvalidArgument}), "%s: expect errors.Is to match the code", codecType)
+		_assert(!errors.Is(err, &Error{Code: CodeNotFound}), "%s: expect errors.Is not to match another code", codecType)
+
+		err = client.Call(context.Background(), "Validator.Check", &BazArgs{Num2: -1}, &reply)
+		_assert(CodeOf(err) == CodeUnknown && err.Error() == "num2 must not be negative",
+			"%s: expect a plain error to be unknown, got %v", codecType, err)
+
+		tests := []struct {
+			serviceMethod string
+			args interface{}
+			code Code
+		}{
+			{"Validator.Missing", &BazArgs{}, CodeNotFound},
+			{"Missing.Check", &BazArgs{}, CodeNotFound},
+			{"Validator", &BazArgs{}, CodeInvalidArgument},
+			{"Slow.Sleep", 1000, CodeDeadlineExceeded},
+			{"Boom.Explode", 1, CodeInternal},
+		}
+		for _, tt := range tests {
+			err = client.Call(context.Background(), tt.serviceMethod, tt.args, &reply)
+			_assert(CodeOf(err) == tt.code, "%s: %s: expect code %s, got %s: %v",
+				codecType, tt.serviceMethod, tt.code, CodeOf(err), err)
+		}
+		_ = client.Close()
+	}
+}
+
+// 请求参数无法解码时错误码为 CodeCodec
+func TestError_CodecCode(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Validator))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.JsonType})
+	defer func() { _ = client.Close() }()
+	var reply int
+	err := client.Call(context.Background(), "Validator.Check", "not an object", &reply)
+	_assert(CodeOf(err) == CodeCodec, "expect CodeCodec, got %s: %v", CodeOf(err), err)
+}
+
+// 没有错误码的响应视为 CodeUnknown，服务端正在关闭的错误码为 CodeUnavailable
+func TestError_Header(t *testing.T) {
+	var h codec.Header
+	setHeaderError(&h, errShuttingDown)
+	_assert(h.Error == errShuttingDown.Error() && Code(h.ErrorCode) == CodeUnavailable, "unexpected header %+v", h)
+	_assert(errors.Is(remoteError(&h), &Error{Code: CodeUnavailable}), "expect the remote error to be unavailable")
+
+	err := remoteError(&codec.Header{Error: "from an old server"})
+	_assert(CodeOf(err) == CodeUnknown && err.Error() == "from an old server", "unexpected error %v", err)
+	_assert(CodeOf(nil) == CodeOK, "expect nil to be ok")
+	_assert(CodePermissionDenied.String() == "permission denied" && Code(99).String() == "code(99)", "unexpected code names")
+}
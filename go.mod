@@ -1,3 +1,12 @@
 module violifer
 
-go 1.15
+go 1.23
+
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.17.11
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.36.12
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
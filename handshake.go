@@ -0,0 +1,202 @@
+package violifer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+连接建立后，客户端与服务端首先进行握手，协商 Option：
+
+客户端发送握手帧：
+| magic 3 字节 | version 1 字节 | length 4 字节 | handshakeRequest（JSON 编码） |
+
+服务端回复确认帧：
+| magic 3 字节 | version 1 字节 | status 1 字节 | length 4 字节 | handshakeAck（JSON 编码） |
+
+服务端设置了认证方式时，在回复协商后的 Option 之前先发送状态为 handshakeChallenge 的确认帧质询客户端，
+客户端回复长度前缀的回应：
+| length 4 字节 | 回应（JSON 编码） |
+
+length 为大端序的 uint32，表示之后数据块的长度，双方都只读取 length 指定的字节，
+因此握手之后的 header 和 body 不会被提前读取。
+magic 为 MagicNumber 的 3 个字节，旧版本的客户端直接发送 JSON 编码的 Option，第一个字节为 '{'，
+服务端据此识别并拒绝旧版本的客户端。
+*/
+
+// 握手协议版本
+const ProtocolVersion byte = 1
+
+// 握手帧的 magic，即 MagicNumber 的 3 个字节
+var handshakeMagic = [3]byte{0x7a, 0x73, 0x6b}
+
+// 握手数据块最大长度
+const maxHandshakeSize = 64 << 10
+
+// 确认帧中的状态
+const (
+	handshakeOK byte = iota
+	// 协议版本不一致
+	handshakeVersionMismatch
+	// Option 不合法，例如不支持的编解码方式
+	handshakeRejected
+	// 认证质询，之后还有确认帧
+	handshakeChallenge
+	// 客户端没有通过认证
+	handshakeUnauthenticated
+)
+
+// 客户端握手信息，在 Option 之外附带只用于握手的字段，JSON 编码时与 Option 的字段位于同一层
+type handshakeRequest struct {
+	*Option
+	// 客户端使用的认证方式，由 Option.Credentials 决定
+	AuthScheme string `json:",omitempty"`
+}
+
+// 服务端确认信息，握手成功时包含协商后的 Option，失败时包含错误信息
+type handshakeAck struct {
+	Option *Option `json:",omitempty"`
+	Error  string  `json:",omitempty"`
+	// 认证质询
+	Challenge []byte `json:",omitempty"`
+	// 服务端注册的幂等方法，握手成功时发送
+	Idempotent []string `json:",omitempty"`
+}
+
+// 客户端与服务端协议版本不一致
+type VersionError struct {
+	Client byte
+	Server byte
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("rpc - protocol version mismatch: client %d, server %d", e.Client, e.Server)
+}
+
+// 旧版本客户端使用 JSON 编码的 Option 作为连接的开头
+var errLegacyClient = errors.New("rpc server - legacy client with JSON option prefix rejected")
+
+// 写入长度前缀和数据块
+func writeBlock(w io.Writer, prefix []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, len(prefix)+4+len(data))
+	buf = append(buf, prefix...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	_, err = w.Write(buf)
+	return err
+}
+
+// 读取长度前缀和数据块，并解码到 v
+func readBlock(r io.Reader, v interface{}) error {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > maxHandshakeSize {
+		return fmt.Errorf("rpc - handshake block too large: %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 客户端发送握手帧
+func writeHandshake(w io.Writer, req *handshakeRequest) error {
+	return writeBlock(w, append(handshakeMagic[:], ProtocolVersion), req)
+}
+
+// 服务端读取握手帧，协议版本不一致时返回 *VersionError
+func readHandshake(r io.Reader) (*handshakeRequest, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:1]); err != nil {
+		return nil, err
+	}
+	if prefix[0] == '{' {
+		return nil, errLegacyClient
+	}
+	if _, err := io.ReadFull(r, prefix[1:]); err != nil {
+		return nil, err
+	}
+	if [3]byte(prefix[:3]) != handshakeMagic {
+		return nil, fmt.Errorf("rpc server - invalid magic number %x", prefix[:3])
+	}
+	if prefix[3] != ProtocolVersion {
+		return nil, &VersionError{Client: prefix[3], Server: ProtocolVersion}
+	}
+
+	req := &handshakeRequest{Option: new(Option)}
+	if err := readBlock(r, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// 设置握手的时间限制，包括 TLS 握手、读取握手帧和认证，超时的连接被关闭，默认为 DefaultOption.ConnectTimeout
+// 0 表示不限制，只对之后建立的连接生效
+func (server *Server) SetHandshakeTimeout(d time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.handshakeTimeout = d
+}
+
+// 服务端回复确认帧
+func writeAck(w io.Writer, status byte, ack *handshakeAck) error {
+	return writeBlock(w, append(handshakeMagic[:], ProtocolVersion, status), ack)
+}
+
+// 客户端读取确认帧，握手成功时返回包含协商后的 Option 的确认信息，收到认证质询时使用 cred 回应
+func readAck(rw io.ReadWriter, cred Credentials) (*handshakeAck, error) {
+	var prefix [5]byte
+	var ack handshakeAck
+	for {
+		if _, err := io.ReadFull(rw, prefix[:]); err != nil {
+			return nil, err
+		}
+		if [3]byte(prefix[:3]) != handshakeMagic {
+			return nil, fmt.Errorf("rpc client - invalid magic number %x", prefix[:3])
+		}
+
+		ack = handshakeAck{}
+		if err := readBlock(rw, &ack); err != nil {
+			return nil, err
+		}
+		if prefix[4] != handshakeChallenge {
+			break
+		}
+		if cred == nil {
+			return nil, fmt.Errorf("%w: server requires authentication", ErrUnauthenticated)
+		}
+		response, err := cred.Respond(ack.Challenge)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBlock(rw, nil, response); err != nil {
+			return nil, err
+		}
+	}
+	switch prefix[4] {
+	case handshakeOK:
+		if ack.Option == nil {
+			return nil, errors.New("rpc client - handshake ack without option")
+		}
+		return &ack, nil
+	case handshakeVersionMismatch:
+		return nil, &VersionError{Client: ProtocolVersion, Server: prefix[3]}
+	case handshakeUnauthenticated:
+		return nil, fmt.Errorf("%w: %s", ErrUnauthenticated, ack.Error)
+	default:
+		return nil, errors.New("rpc client - handshake rejected: " + ack.Error)
+	}
+}
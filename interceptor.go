@@ -0,0 +1,93 @@
+package violifer
+
+import (
+	"context"
+	"reflect"
+	"violifer/codec"
+)
+
+// 服务端处理一次请求的函数，argv 为请求参数，replyv 为指向返回值的指针
+type ServerHandler func(ctx context.Context, argv, replyv interface{}) error
+
+// 服务端拦截器，在调用服务方法前后执行日志、认证、监控、参数校验等通用逻辑
+// 调用 next 继续执行后续的拦截器和服务方法，不调用 next 直接返回错误即可中断请求，错误通过 Header.Error 返回给客户端
+// 返回值需要通过 replyv 指针修改，替换 replyv 不会影响发送给客户端的响应
+// h 是请求 header 的副本，修改 h 不会影响发送给客户端的响应，响应元数据通过 SetResponseMetadata 设置
+type ServerInterceptor func(ctx context.Context, serviceMethod string, h *codec.Header,
+	argv, replyv interface{}, next ServerHandler) error
+
+// 添加服务端拦截器，拦截器按照添加的顺序执行
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	// 复制一份新的切片，正在处理的请求仍使用旧的拦截器链
+	chain := make([]ServerInterceptor, 0, len(server.interceptors)+len(interceptors))
+	chain = append(chain, server.interceptors...)
+	server.interceptors = append(chain, interceptors...)
+}
+
+// 添加默认 Server 的拦截器
+func Use(interceptors ...ServerInterceptor) {
+	DefaultServer.Use(interceptors...)
+}
+
+// 经过拦截器链调用请求对应的服务方法，h 为传给拦截器的请求 header 副本
+func (server *Server) invoke(ctx context.Context, req *request, h *codec.Header) error {
+	server.mutex.Lock()
+	interceptors := server.interceptors
+	server.mutex.Unlock()
+
+	handler := func(ctx context.Context, argv, replyv interface{}) error {
+		return req.svc.call(ctx, req.mtype, reflect.ValueOf(argv), reflect.ValueOf(replyv))
+	}
+	// 从后向前包装，使第一个添加的拦截器最先执行
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, argv, replyv interface{}) error {
+			return interceptor(ctx, h.ServiceMethod, h, argv, replyv, next)
+		}
+	}
+	return handler(ctx, req.argv.Interface(), req.replyv.Interface())
+}
+
+// 客户端发起一次调用的函数
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// 客户端拦截器，在 Client.Call 和 Client.Go 发起调用前后执行重试、日志、监控、注入元数据等通用逻辑
+// 调用 next 继续执行后续的拦截器并发起调用，可以修改 ctx 和参数，也可以不调用 next 直接返回
+type ClientInterceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error
+
+// 添加客户端拦截器，拦截器按照添加的顺序执行，Option.Interceptors 中的拦截器最先执行
+func (client *Client) Use(interceptors ...ClientInterceptor) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	chain := make([]ClientInterceptor, 0, len(client.interceptors)+len(interceptors))
+	chain = append(chain, client.interceptors...)
+	client.interceptors = append(chain, interceptors...)
+}
+
+// 返回客户端的拦截器链
+func (client *Client) interceptorChain() []ClientInterceptor {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if len(client.opt.Interceptors) == 0 {
+		return client.interceptors
+	}
+	chain := make([]ClientInterceptor, 0, len(client.opt.Interceptors)+len(client.interceptors))
+	chain = append(chain, client.opt.Interceptors...)
+	return append(chain, client.interceptors...)
+}
+
+// 使用拦截器链包装 invoker，第一个拦截器最先执行
+func chainInvoker(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
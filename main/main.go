@@ -103,8 +103,9 @@ func broadcast(registry string) {
 			defer wg.Done()
 
 			foo(xc, context.Background(), "broadcast", "Foo.Sum", &Args{Num1: i, Num2: i * i})
-			ctx, _ := context.WithTimeout(context.Background(), time.Second * 2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second * 2)
 			foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
+			cancel()
 		}(i)
 	}
 	wg.Wait()
@@ -0,0 +1,94 @@
+package violifer
+
+import (
+	"context"
+	"sync"
+)
+
+// 请求或响应携带的元数据，例如请求 ID、认证信息、租户 ID、链路追踪信息
+// 客户端通过 NewOutgoingContext 为请求附加元数据，
+// 服务端方法通过 FromIncomingContext 读取请求的元数据，通过 SetResponseMetadata 设置响应的元数据
+type Metadata map[string]string
+
+// 复制元数据，避免被外部修改
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	c := make(Metadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+type responseKey struct{}
+type responseHolderKey struct{}
+
+// 返回附加了请求元数据的 ctx，使用该 ctx 发起的调用会将元数据发送给服务端
+// 多次调用时元数据合并，相同的键以后者为准
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	merged, _ := FromOutgoingContext(ctx)
+	for k, v := range md {
+		if merged == nil {
+			merged = make(Metadata, len(md))
+		}
+		merged[k] = v
+	}
+	return context.WithValue(ctx, outgoingKey{}, merged)
+}
+
+// 返回 ctx 中附加的请求元数据的副本
+func FromOutgoingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(Metadata)
+	return md.Copy(), ok
+}
+
+// 返回服务端收到的请求元数据的副本，在接收 context.Context 的服务方法中使用
+func FromIncomingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(incomingKey{}).(Metadata)
+	return md.Copy(), ok
+}
+
+// 服务端一次请求的响应元数据
+type responseMetadata struct {
+	mutex sync.Mutex
+	md    Metadata
+}
+
+// 设置响应元数据，在接收 context.Context 的服务方法中使用，响应发送给客户端时一并发送
+func SetResponseMetadata(ctx context.Context, key, value string) {
+	r, ok := ctx.Value(responseKey{}).(*responseMetadata)
+	if !ok {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.md == nil {
+		r.md = make(Metadata)
+	}
+	r.md[key] = value
+}
+
+// 服务端为一次请求创建 ctx，附加请求元数据和响应元数据
+func newIncomingContext(ctx context.Context, md Metadata) (context.Context, *responseMetadata) {
+	r := new(responseMetadata)
+	ctx = context.WithValue(ctx, incomingKey{}, md)
+	return context.WithValue(ctx, responseKey{}, r), r
+}
+
+// 返回已经设置的响应元数据的副本
+func (r *responseMetadata) get() Metadata {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.md.Copy()
+}
+
+// 返回一个 ctx，使用该 ctx 调用 Client.Call 完成后，md 被设置为服务端返回的响应元数据
+func WithResponseMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, responseHolderKey{}, md)
+}
@@ -0,0 +1,166 @@
+package violifer
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"violifer/codec"
+)
+
+// 回调
+// 连接是对等的：客户端通过 Client.Register 注册本地服务后，服务端可以通过连接对应的 Peer 调用客户端的方法
+// 服务端发出的请求为 MsgCallback，客户端的响应为 MsgCallbackReply，序列号与客户端发出的请求相互独立
+// 服务方法可以通过 PeerFromContext 得到当前连接的 Peer，也可以通过 Server.Peers 得到所有连接的 Peer
+
+// 服务端的一个连接，可以用于调用客户端注册的服务
+type Peer struct {
+	cc codec.Codec
+	sendingMutex *sync.Mutex
+
+	// 保护 seq、pending 和 closed
+	mutex sync.Mutex
+	// 回调请求的序列号，从 1 开始
+	seq uint64
+	// 等待客户端响应的回调请求，序列号为键
+	pending map[uint64]*Call
+	// 连接已经断开
+	closed bool
+
+	// 客户端地址，不是网络连接时为 nil
+	remoteAddr net.Addr
+	// TLS 连接的状态，不是 TLS 连接时为 nil
+	tlsState *tls.ConnectionState
+	// 认证得到的客户端身份，服务端没有设置认证方式时为 nil
+	principal *Principal
+}
+
+func newPeer(conn io.ReadWriteCloser, cc codec.Codec, sendingMutex *sync.Mutex) *Peer {
+	p := &Peer{
+		cc: cc,
+		sendingMutex: sendingMutex,
+		seq: 1,
+		pending: make(map[uint64]*Call),
+	}
+	if c, ok := conn.(net.Conn); ok {
+		p.remoteAddr = c.RemoteAddr()
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		state := c.ConnectionState()
+		p.tlsState = &state
+	}
+	return p
+}
+
+// 返回客户端地址，不是网络连接时返回 nil
+func (p *Peer) RemoteAddr() net.Addr {
+	return p.remoteAddr
+}
+
+type peerKey struct{}
+
+// 返回处理当前请求的连接，在接收 context.Context 的服务方法和服务端拦截器中使用
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// 返回当前所有连接的 Peer
+func (server *Server) Peers() []*Peer {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	peers := make([]*Peer, 0, len(server.conns))
+	for p := range server.conns {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// 调用客户端注册的服务方法，等待响应返回
+// ctx 的截止时间和元数据与 Client.Call 一样发送给客户端，ctx 结束时不再等待响应
+func (p *Peer) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := newCall(ctx, serviceMethod, args, reply, make(chan *Call, 1))
+	p.send(call)
+	select {
+	case <- ctx.Done():
+		p.removeCall(call.Seq)
+		return contextError("rpc server - callback failed", ctx.Err())
+	case call := <- call.Done:
+		return call.Error
+	}
+}
+
+func (p *Peer) send(call *Call) {
+	p.sendingMutex.Lock()
+	defer p.sendingMutex.Unlock()
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		call.Error = ErrShutdown
+		call.done()
+		return
+	}
+	call.Seq = p.seq
+	p.pending[call.Seq] = call
+	p.seq++
+	p.mutex.Unlock()
+
+	h := &codec.Header{ServiceMethod: call.ServiceMethod, Seq: call.Seq, Type: codec.MsgCallback}
+	h.Timeout = remainingTimeout(call.ctx)
+	h.Metadata, _ = FromOutgoingContext(call.ctx)
+	if err := p.cc.Write(h, call.Args); err != nil {
+		if call := p.removeCall(call.Seq); call != nil {
+			call.Error = err
+			call.done()
+		}
+	}
+}
+
+func (p *Peer) removeCall(seq uint64) *Call {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	call := p.pending[seq]
+	delete(p.pending, seq)
+	return call
+}
+
+// 读取客户端对回调请求的响应，由连接的读协程调用
+func (p *Peer) receive(h *codec.Header) {
+	call := p.removeCall(h.Seq)
+	if call == nil {
+		// 回调请求已经不再等待响应
+		_ = p.cc.ReadBody(nil)
+		return
+	}
+
+	var err error
+	if h.Error != "" {
+		call.Error = remoteError(h)
+		err = p.cc.ReadBody(nil)
+	} else if err = p.cc.ReadBody(call.Reply); err != nil {
+		call.Error = NewError(CodeCodec, "reading body " + err.Error())
+	}
+	call.Metadata = h.Metadata
+	call.done()
+	if err != nil {
+		log.Println("rpc server - read callback reply error:", err)
+	}
+}
+
+// 连接断开，结束所有等待响应的回调请求
+func (p *Peer) terminate() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	for seq, call := range p.pending {
+		delete(p.pending, seq)
+		call.Error = ErrShutdown
+		call.done()
+	}
+}
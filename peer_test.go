@@ -0,0 +1,64 @@
+package violifer
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 客户端注册的本地服务
+type Config struct {
+	updates chan string
+}
+
+func (c *Config) Update(args string, reply *int) error {
+	c.updates <- args
+	*reply = len(args)
+	return nil
+}
+
+type Hub int
+
+// 处理请求的过程中回调客户端
+func (h Hub) Subscribe(ctx context.Context, args string, reply *int) error {
+	peer, ok := PeerFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return peer.Call(ctx, "Config.Update", "welcome "+args, reply)
+}
+
+// 服务端通过 Peer 调用客户端注册的服务，回调可以发生在处理请求的过程中，也可以由服务端主动发起
+func TestPeer_Call(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Hub))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	config := &Config{updates: make(chan string, 2)}
+	client, _ := Dial("tcp", l.Addr().String())
+	_assert(client.Register(config) == nil, "failed to register the client service")
+
+	var reply int
+	err := client.Call(context.Background(), "Hub.Subscribe", "alice", &reply)
+	_assert(err == nil && reply == len("welcome alice"), "failed to call back during Hub.Subscribe: %v", err)
+	_assert(<-config.updates == "welcome alice", "expect the client service to be called")
+
+	peers := server.Peers()
+	_assert(len(peers) == 1, "expect 1 peer, got %d", len(peers))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = peers[0].Call(ctx, "Config.Update", "v2", &reply)
+	_assert(err == nil && reply == 2 && <-config.updates == "v2", "failed to push to the client: %v", err)
+	err = peers[0].Call(ctx, "Config.Missing", "v3", &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a missing method error, got %v", err)
+
+	_ = client.Close()
+	time.Sleep(time.Millisecond * 100)
+	err = peers[0].Call(ctx, "Config.Update", "v4", &reply)
+	_assert(err == ErrShutdown, "expect ErrShutdown after the client closes, got %v", err)
+	_assert(len(server.Peers()) == 0, "expect the peer to be removed")
+}
@@ -0,0 +1,295 @@
+package violifer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 连接池
+// 一个 Client 的所有请求都通过同一个 sendingMutex 发送，在多核机器上单个连接会成为瓶颈，
+// 连接池为同一个地址维护最多 Size 个连接，按需建立，每次调用按照 PoolSelectMode 选择一个连接
+// 空闲超过 IdleTimeout 的连接被关闭，存在超过 MaxLifetime 的连接不再接收新的调用，已经发出的调用完成后关闭
+// 连接池可以单独使用，也可以通过 XClient.SetPool 在 XClient 中为每个地址使用一个连接池
+
+// 连接池选择连接的方式
+type PoolSelectMode int
+
+const (
+	// 选择正在处理的调用最少的连接，所有连接都有调用且连接数没有达到上限时建立新的连接
+	PoolLeastPending PoolSelectMode = iota
+	// 依次使用每个连接
+	PoolRoundRobin
+)
+
+// 连接池选项
+type PoolOption struct {
+	// 最大连接数，默认为 4
+	Size int
+	// 选择连接的方式
+	Mode PoolSelectMode
+	// 连接空闲超过该时间后关闭，0 表示不关闭
+	IdleTimeout time.Duration
+	// 连接建立超过该时间后替换为新的连接，0 表示不限制
+	MaxLifetime time.Duration
+}
+
+// 默认最大连接数
+const DefaultPoolSize = 4
+
+// 连接池中的一个连接
+type pooledConn struct {
+	// 建立连接期间为 nil
+	client *Client
+	// 建立连接结束后关闭，err 为建立连接的错误
+	ready chan struct{}
+	err error
+	created time.Time
+	// 最后一次调用结束的时间
+	lastUsed time.Time
+	// 正在处理的调用数
+	inflight int
+	// 已经从连接池中移除，调用全部结束后关闭
+	retired bool
+}
+
+// 连接不可用或存在时间超过 maxLifetime，正在建立的连接不会过期
+func (pc *pooledConn) expired(now time.Time, maxLifetime time.Duration) bool {
+	if pc.client == nil {
+		return false
+	}
+	return !pc.client.IsAvailable() || (maxLifetime > 0 && now.Sub(pc.created) >= maxLifetime)
+}
+
+type Pool struct {
+	rpcAddr string
+	opt *Option
+	popt PoolOption
+
+	mutex sync.Mutex
+	// 长度为 Size，未建立连接的位置为 nil
+	conns []*pooledConn
+	// 轮询的下一个位置
+	next int
+	closed bool
+	// 关闭连接池时关闭，结束清理协程
+	done chan struct{}
+}
+
+// 创建连接池，rpcAddr 的格式与 XDial 相同，连接在第一次调用时建立
+// popt 为 nil 时使用默认选项
+func NewPool(rpcAddr string, opt *Option, popt *PoolOption) *Pool {
+	p := &Pool{
+		rpcAddr: rpcAddr,
+		opt: opt,
+		done: make(chan struct{}),
+	}
+	if popt != nil {
+		p.popt = *popt
+	}
+	if p.popt.Size <= 0 {
+		p.popt.Size = DefaultPoolSize
+	}
+	p.conns = make([]*pooledConn, p.popt.Size)
+	if p.popt.IdleTimeout > 0 || p.popt.MaxLifetime > 0 {
+		go p.evict()
+	}
+	return p
+}
+
+// 选择一个连接并增加它的调用数，需要时建立新的连接
+// 持有锁占用空位后释放锁建立连接，建立连接期间其他调用仍可以使用已有的连接，选中该位置的调用等待连接建立完成
+func (p *Pool) get() (*pooledConn, error) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, ErrShutdown
+	}
+	now := time.Now()
+	for i, pc := range p.conns {
+		if pc != nil && pc.expired(now, p.popt.MaxLifetime) {
+			p.retire(i)
+		}
+	}
+
+	var i int
+	switch p.popt.Mode {
+	case PoolRoundRobin:
+		i = p.next
+		p.next = (p.next + 1) % len(p.conns)
+	default:
+		// 调用最少的连接和第一个空位
+		best, empty := -1, -1
+		for j, pc := range p.conns {
+			if pc == nil {
+				if empty < 0 {
+					empty = j
+				}
+				continue
+			}
+			if best < 0 || pc.inflight < p.conns[best].inflight {
+				best = j
+			}
+		}
+		i = best
+		// 所有已有连接都有调用时才使用空位
+		if best < 0 || (empty >= 0 && p.conns[best].inflight > 0) {
+			i = empty
+		}
+	}
+
+	pc := p.conns[i]
+	dial := pc == nil
+	if dial {
+		pc = &pooledConn{ready: make(chan struct{})}
+		p.conns[i] = pc
+	}
+	pc.inflight++
+	p.mutex.Unlock()
+
+	if dial {
+		p.dial(i, pc)
+	}
+	<- pc.ready
+	if pc.err != nil {
+		return nil, &NotSentError{Err: pc.err}
+	}
+	return pc, nil
+}
+
+// 为位置 i 上占用的 pc 建立连接，结束后唤醒等待该连接的调用，失败时释放该位置
+func (p *Pool) dial(i int, pc *pooledConn) {
+	client, err := XDial(p.rpcAddr, p.opt)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	defer close(pc.ready)
+
+	if err == nil && p.closed {
+		_ = client.Close()
+		err = ErrShutdown
+	}
+	if err != nil {
+		pc.err = err
+		if p.conns[i] == pc {
+			p.conns[i] = nil
+		}
+		return
+	}
+	now := time.Now()
+	pc.client, pc.created, pc.lastUsed = client, now, now
+}
+
+// 调用结束，减少连接的调用数，已经移除的连接没有调用时关闭
+func (p *Pool) put(pc *pooledConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pc.inflight--
+	pc.lastUsed = time.Now()
+	if pc.retired && pc.inflight == 0 {
+		_ = pc.client.Close()
+	}
+}
+
+// 从连接池中移除位置 i 的连接，没有调用时立即关闭，需要持有 p.mutex
+func (p *Pool) retire(i int) {
+	pc := p.conns[i]
+	p.conns[i] = nil
+	pc.retired = true
+	if pc.inflight == 0 {
+		_ = pc.client.Close()
+	}
+}
+
+// 清理协程检查连接的最小周期
+const minEvictInterval = time.Millisecond
+
+// 定期关闭空闲和过期的连接
+func (p *Pool) evict() {
+	interval := p.popt.IdleTimeout
+	if interval <= 0 || (p.popt.MaxLifetime > 0 && p.popt.MaxLifetime < interval) {
+		interval = p.popt.MaxLifetime
+	}
+	interval /= 2
+	if interval < minEvictInterval {
+		interval = minEvictInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- p.done:
+			return
+		case now := <- ticker.C:
+			p.mutex.Lock()
+			for i, pc := range p.conns {
+				if pc == nil || pc.inflight > 0 {
+					continue
+				}
+				if pc.expired(now, p.popt.MaxLifetime) ||
+					(p.popt.IdleTimeout > 0 && now.Sub(pc.lastUsed) >= p.popt.IdleTimeout) {
+					p.retire(i)
+				}
+			}
+			p.mutex.Unlock()
+		}
+	}
+}
+
+// 通过连接池中的一个连接调用服务方法，等待响应返回
+func (p *Pool) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	pc, err := p.get()
+	if err != nil {
+		return err
+	}
+	defer p.put(pc)
+	return pc.client.Call(ctx, serviceMethod, args, reply)
+}
+
+// 服务端是否将 serviceMethod 注册为幂等方法，没有建立连接时返回 false
+func (p *Pool) IsIdempotent(serviceMethod string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, pc := range p.conns {
+		if pc != nil && pc.client != nil {
+			return pc.client.IsIdempotent(serviceMethod)
+		}
+	}
+	return false
+}
+
+// 返回当前建立的连接数
+func (p *Pool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := 0
+	for _, pc := range p.conns {
+		if pc != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// 关闭连接池和其中的所有连接
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return ErrShutdown
+	}
+	p.closed = true
+	close(p.done)
+	// 正在建立的连接在建立完成后关闭
+	for i, pc := range p.conns {
+		if pc != nil && pc.client != nil {
+			_ = pc.client.Close()
+		}
+		p.conns[i] = nil
+	}
+	return nil
+}
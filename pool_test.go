@@ -0,0 +1,179 @@
+package violifer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Conn int
+
+// 返回处理请求的连接的客户端地址，等待 args 毫秒
+func (c Conn) Addr(ctx context.Context, args int, reply *string) error {
+	time.Sleep(time.Duration(args) * time.Millisecond)
+	if peer, ok := PeerFromContext(ctx); ok {
+		*reply = peer.RemoteAddr().String()
+	}
+	return nil
+}
+
+func startPoolServer() string {
+	server := NewServer()
+	_ = server.Register(new(Conn))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+// 并发调用 n 次，返回使用的不同连接数
+func poolConcurrentCalls(p *Pool, n, delay int) int {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	addrs := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var addr string
+			err := p.Call(context.Background(), "Conn.Addr", delay, &addr)
+			_assert(err == nil, "failed to call: %v", err)
+			mutex.Lock()
+			addrs[addr] = true
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	return len(addrs)
+}
+
+// 最少调用优先：没有调用时复用已有连接，并发调用时按需建立新的连接，不超过 Size
+func TestPool_LeastPending(t *testing.T) {
+	t.Parallel()
+	p := NewPool(startPoolServer(), nil, &PoolOption{Size: 3})
+	defer func() { _ = p.Close() }()
+
+	var first, second string
+	_ = p.Call(context.Background(), "Conn.Addr", 0, &first)
+	_ = p.Call(context.Background(), "Conn.Addr", 0, &second)
+	_assert(first == second && p.Len() == 1, "expect sequential calls to share a connection, got %d", p.Len())
+
+	n := poolConcurrentCalls(p, 6, 100)
+	_assert(n == 3 && p.Len() == 3, "expect 3 connections, got %d used and %d open", n, p.Len())
+}
+
+// 轮询：依次使用每个连接
+func TestPool_RoundRobin(t *testing.T) {
+	t.Parallel()
+	p := NewPool(startPoolServer(), nil, &PoolOption{Size: 2, Mode: PoolRoundRobin})
+	defer func() { _ = p.Close() }()
+
+	addrs := make([]string, 4)
+	for i := range addrs {
+		_ = p.Call(context.Background(), "Conn.Addr", 0, &addrs[i])
+	}
+	_assert(addrs[0] != addrs[1] && addrs[0] == addrs[2] && addrs[1] == addrs[3], "expect alternating connections: %v", addrs)
+}
+
+// 空闲的连接被关闭，过期的连接被替换，正在处理的调用不受影响
+func TestPool_Eviction(t *testing.T) {
+	t.Parallel()
+	rpcAddr := startPoolServer()
+
+	idle := NewPool(rpcAddr, nil, &PoolOption{Size: 2, IdleTimeout: time.Millisecond * 50})
+	defer func() { _ = idle.Close() }()
+	var addr string
+	_ = idle.Call(context.Background(), "Conn.Addr", 0, &addr)
+	_assert(idle.Len() == 1, "expect 1 connection")
+	time.Sleep(time.Millisecond * 200)
+	_assert(idle.Len() == 0, "expect the idle connection to be closed")
+	err := idle.Call(context.Background(), "Conn.Addr", 0, &addr)
+	_assert(err == nil && idle.Len() == 1, "expect a new connection after eviction: %v", err)
+
+	rotating := NewPool(rpcAddr, nil, &PoolOption{Size: 1, MaxLifetime: time.Millisecond * 100})
+	defer func() { _ = rotating.Close() }()
+	var before, during, after string
+	_ = rotating.Call(context.Background(), "Conn.Addr", 0, &before)
+	// 调用过程中连接过期，调用仍然完成
+	err = rotating.Call(context.Background(), "Conn.Addr", 300, &during)
+	_assert(err == nil && during == before, "expect the in-flight call to finish on the old connection: %v", err)
+	_ = rotating.Call(context.Background(), "Conn.Addr", 0, &after)
+	_assert(after != before, "expect the expired connection to be replaced")
+}
+
+// 第一个连接之后，每次 Accept 前等待 delay，模拟建立连接很慢的服务端
+type slowListener struct {
+	net.Listener
+	accepted int32
+	delay time.Duration
+}
+
+func (l *slowListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.accepted, 1) > 1 {
+		time.Sleep(l.delay)
+	}
+	return l.Listener.Accept()
+}
+
+// 建立新的连接时不阻塞使用已有连接的调用
+func TestPool_DialWithoutLock(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Conn))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(&slowListener{Listener: l, delay: time.Millisecond * 500})
+	p := NewPool("tcp@" + l.Addr().String(), nil, &PoolOption{Size: 2})
+	defer func() { _ = p.Close() }()
+
+	var first string
+	_ = p.Call(context.Background(), "Conn.Addr", 0, &first)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// 第一个连接上有调用，第二个调用建立新的连接，等待服务端 Accept
+	go func() {
+		defer wg.Done()
+		var addr string
+		_ = p.Call(context.Background(), "Conn.Addr", 100, &addr)
+	}()
+	time.Sleep(time.Millisecond * 20)
+	go func() {
+		defer wg.Done()
+		var addr string
+		err := p.Call(context.Background(), "Conn.Addr", 0, &addr)
+		_assert(err == nil && addr != first, "expect the call to use a new connection: %v", err)
+	}()
+	time.Sleep(time.Millisecond * 20)
+
+	start := time.Now()
+	var addr string
+	err := p.Call(context.Background(), "Conn.Addr", 0, &addr)
+	_assert(err == nil && addr == first, "expect the call to use the existing connection: %v", err)
+	_assert(time.Since(start) < time.Millisecond * 300, "expect the call not to wait for the dial, took %s", time.Since(start))
+	wg.Wait()
+}
+
+// 很小的 IdleTimeout 和 MaxLifetime 不会导致清理协程 panic
+func TestPool_TinyTimeout(t *testing.T) {
+	t.Parallel()
+	p := NewPool(startPoolServer(), nil, &PoolOption{IdleTimeout: 1, MaxLifetime: 1})
+	defer func() { _ = p.Close() }()
+	time.Sleep(time.Millisecond * 10)
+	var addr string
+	err := p.Call(context.Background(), "Conn.Addr", 0, &addr)
+	_assert(err == nil, "failed to call: %v", err)
+}
+
+// 多个连接同时建立时共用调用方的 Option，不会修改它
+func TestPool_SharedOption(t *testing.T) {
+	t.Parallel()
+	opt := &Option{CodecType: DefaultOption.CodecType, ConnectTimeout: time.Second}
+	p := NewPool(startPoolServer(), opt, &PoolOption{Size: 4})
+	defer func() { _ = p.Close() }()
+
+	n := poolConcurrentCalls(p, 8, 50)
+	_assert(n == 4, "expect 4 connections, got %d", n)
+	_assert(opt.MagicNumber == 0, "expect the caller's option to be left unchanged")
+}
@@ -0,0 +1,304 @@
+package violifer
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 自动重连的客户端
+// 连接断开或服务端正在关闭时，按照指数退避加随机抖动的间隔重新连接，重新连接会重新握手（包括认证），
+// 并重新注册通过 Register 注册的本地服务
+// 连接不可用期间发起的调用按照 ReconnectOption.Policy 排队等待或直接失败，
+// 连接断开时已经发出的调用返回错误码为 CodeUnavailable 的错误，不会自动重试
+
+// 连接状态
+type ConnState int
+
+const (
+	// 正在连接
+	StateConnecting ConnState = iota
+	// 连接可用
+	StateReady
+	// 连接失败或断开，等待下一次重连
+	StateTransientFailure
+	// 客户端已经关闭
+	StateShutdown
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateReady:
+		return "ready"
+	case StateTransientFailure:
+		return "transient failure"
+	case StateShutdown:
+		return "shutdown"
+	}
+	return "unknown"
+}
+
+// 连接不可用时新调用的处理方式
+type ReconnectPolicy int
+
+const (
+	// 直接返回错误码为 CodeUnavailable 的错误
+	FailWhenDisconnected ReconnectPolicy = iota
+	// 等待连接可用或 ctx 结束
+	QueueWhenDisconnected
+)
+
+// 重连选项
+type ReconnectOption struct {
+	// 第一次重连前的等待时间，默认 100 毫秒
+	MinBackoff time.Duration
+	// 重连等待时间的上限，默认 10 秒
+	MaxBackoff time.Duration
+	// 每次失败后等待时间的倍数，默认 2
+	Multiplier float64
+	// 随机抖动的比例，等待时间在 [1-Jitter, 1+Jitter] 倍之间浮动，默认 0.2
+	Jitter float64
+	// 连接不可用时新调用的处理方式
+	Policy ReconnectPolicy
+	// 连接状态变化时调用，不能阻塞，也不能调用 Close；StateShutdown 在 Close 中调用，其他状态在重连协程中调用
+	// 回调依次调用，不会并发，顺序与状态变化的顺序相同，StateShutdown 之后不会再调用
+	OnStateChange func(state ConnState)
+}
+
+// 默认重连选项
+var DefaultReconnectOption = &ReconnectOption{
+	MinBackoff: time.Millisecond * 100,
+	MaxBackoff: time.Second * 10,
+	Multiplier: 2,
+	Jitter: 0.2,
+}
+
+// 连接不可用，且 Policy 为 FailWhenDisconnected，请求没有发送到服务端
+// 错误码为 CodeUnavailable，errors.Is(err, ErrDisconnected) 只匹配正在重连的情况，不匹配服务端关闭等其他不可用的错误
+var ErrDisconnected error = &NotSentError{Err: NewError(CodeUnavailable, "rpc client - disconnected, reconnecting")}
+
+type ReconnectingClient struct {
+	rpcAddr string
+	opt *Option
+	ropt ReconnectOption
+
+	mutex sync.Mutex
+	// 保证 OnStateChange 依次调用，先于 mutex 获取
+	callbackMutex sync.Mutex
+	// 当前的连接，正在重连时为 nil
+	client *Client
+	// 连接可用时关闭，唤醒排队的调用
+	ready chan struct{}
+	state ConnState
+	// 通过 Register 注册的本地服务，重连后重新注册
+	rcvrs []interface{}
+	closed bool
+	// 关闭客户端时关闭，结束重连协程
+	done chan struct{}
+}
+
+// 创建自动重连的客户端，rpcAddr 的格式与 XDial 相同，在后台建立连接，立即返回
+// ropt 为 nil 时使用 DefaultReconnectOption，零值字段使用 DefaultReconnectOption 中对应的值
+func DialReconnecting(rpcAddr string, opt *Option, ropt *ReconnectOption) *ReconnectingClient {
+	rc := &ReconnectingClient{
+		rpcAddr: rpcAddr,
+		opt: opt,
+		ready: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if ropt != nil {
+		rc.ropt = *ropt
+	}
+	if rc.ropt.MinBackoff <= 0 {
+		rc.ropt.MinBackoff = DefaultReconnectOption.MinBackoff
+	}
+	if rc.ropt.MaxBackoff <= 0 {
+		rc.ropt.MaxBackoff = DefaultReconnectOption.MaxBackoff
+	}
+	if rc.ropt.Multiplier < 1 {
+		rc.ropt.Multiplier = DefaultReconnectOption.Multiplier
+	}
+	if rc.ropt.Jitter <= 0 {
+		rc.ropt.Jitter = DefaultReconnectOption.Jitter
+	}
+	go rc.run()
+	return rc
+}
+
+// 修改状态并通知 OnStateChange，关闭之后只接受 StateShutdown
+// 持有 callbackMutex 直到回调返回，回调的顺序与状态变化的顺序相同
+func (rc *ReconnectingClient) setState(state ConnState) {
+	rc.callbackMutex.Lock()
+	defer rc.callbackMutex.Unlock()
+
+	rc.mutex.Lock()
+	if rc.closed && state != StateShutdown {
+		rc.mutex.Unlock()
+		return
+	}
+	rc.state = state
+	rc.mutex.Unlock()
+	if rc.ropt.OnStateChange != nil {
+		rc.ropt.OnStateChange(state)
+	}
+}
+
+// 返回当前的连接状态
+func (rc *ReconnectingClient) State() ConnState {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	return rc.state
+}
+
+// 重连协程，连接可用时等待连接不可用，之后退避并重新连接
+func (rc *ReconnectingClient) run() {
+	backoff := rc.ropt.MinBackoff
+	for {
+		rc.setState(StateConnecting)
+		client, err := XDial(rc.rpcAddr, rc.opt)
+		if err == nil {
+			rc.mutex.Lock()
+			if rc.closed {
+				rc.mutex.Unlock()
+				_ = client.Close()
+				return
+			}
+			// 持有锁注册本地服务，保证与 Register 不会遗漏
+			for _, rcvr := range rc.rcvrs {
+				_ = client.Register(rcvr)
+			}
+			rc.client = client
+			close(rc.ready)
+			rc.mutex.Unlock()
+			rc.setState(StateReady)
+			backoff = rc.ropt.MinBackoff
+
+			select {
+			case <- client.unavailable:
+			case <- rc.done:
+				return
+			}
+			// 服务端正在关闭时，已经发出的调用仍会收到响应，响应全部返回后关闭旧连接；连接已经断开时立即关闭
+			_ = client.CloseWhenIdle()
+			rc.mutex.Lock()
+			rc.resetClient(client)
+			rc.mutex.Unlock()
+		}
+		rc.setState(StateTransientFailure)
+
+		select {
+		case <- time.After(rc.jitter(backoff)):
+		case <- rc.done:
+			return
+		}
+		if err != nil {
+			backoff = time.Duration(float64(backoff) * rc.ropt.Multiplier)
+			if backoff > rc.ropt.MaxBackoff {
+				backoff = rc.ropt.MaxBackoff
+			}
+		}
+	}
+}
+
+// 连接不可用时移除，之后的调用等待新的 ready，需要持有 rc.mutex
+func (rc *ReconnectingClient) resetClient(client *Client) {
+	if rc.client == client {
+		rc.client = nil
+		rc.ready = make(chan struct{})
+	}
+}
+
+// 为等待时间加上随机抖动
+func (rc *ReconnectingClient) jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + rc.ropt.Jitter*(rand.Float64()*2-1)))
+}
+
+// 返回当前可用的连接，连接不可用时按照 Policy 等待或返回 ErrDisconnected
+// 可以用于 Stream、Batch 等没有直接封装的调用方式
+func (rc *ReconnectingClient) Client(ctx context.Context) (*Client, error) {
+	for {
+		rc.mutex.Lock()
+		if rc.closed {
+			rc.mutex.Unlock()
+			return nil, ErrShutdown
+		}
+		if rc.client != nil {
+			if rc.client.IsAvailable() {
+				client := rc.client
+				rc.mutex.Unlock()
+				return client, nil
+			}
+			// 连接刚刚不可用，重连协程还没有处理
+			rc.resetClient(rc.client)
+		}
+		ready := rc.ready
+		rc.mutex.Unlock()
+		if rc.ropt.Policy == FailWhenDisconnected {
+			return nil, ErrDisconnected
+		}
+
+		select {
+		case <- ctx.Done():
+			return nil, Errorf(CodeUnavailable, "rpc client - wait for connection: %v", ctx.Err())
+		case <- rc.done:
+			return nil, ErrShutdown
+		case <- ready:
+		}
+	}
+}
+
+// 调用服务方法，等待响应返回
+func (rc *ReconnectingClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	client, err := rc.Client(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Call(ctx, serviceMethod, args, reply)
+}
+
+// 发送单向通知，连接不可用时按照 Policy 等待或返回 ErrDisconnected
+func (rc *ReconnectingClient) Notify(ctx context.Context, serviceMethod string, args interface{}) error {
+	client, err := rc.Client(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Notify(serviceMethod, args)
+}
+
+// 注册本地服务，当前的连接和之后重连建立的连接都会注册
+func (rc *ReconnectingClient) Register(rcvr interface{}) error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.client != nil {
+		if err := rc.client.Register(rcvr); err != nil {
+			return err
+		}
+	}
+	rc.rcvrs = append(rc.rcvrs, rcvr)
+	return nil
+}
+
+// 关闭客户端，停止重连
+func (rc *ReconnectingClient) Close() error {
+	rc.mutex.Lock()
+	if rc.closed {
+		rc.mutex.Unlock()
+		return ErrShutdown
+	}
+	rc.closed = true
+	close(rc.done)
+	client := rc.client
+	rc.client = nil
+	rc.mutex.Unlock()
+
+	rc.setState(StateShutdown)
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package violifer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录状态变化
+type stateRecorder struct {
+	mutex sync.Mutex
+	states []string
+}
+
+func (r *stateRecorder) record(state ConnState) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.states = append(r.states, state.String())
+}
+
+func (r *stateRecorder) String() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return strings.Join(r.states, ",")
+}
+
+func startReconnectServer(addr string) (*Server, string) {
+	server := NewServer()
+	_ = server.Register(new(Baz))
+	_ = server.Register(new(Hub))
+	l, err := net.Listen("tcp", addr)
+	_assert(err == nil, "failed to listen on %s: %v", addr, err)
+	go server.Accept(l)
+	return server, l.Addr().String()
+}
+
+// 服务端重启后自动重连，重连期间的调用排队等待，本地服务在新的连接上重新注册
+func TestReconnectingClient_Queue(t *testing.T) {
+	t.Parallel()
+	server, addr := startReconnectServer("127.0.0.1:0")
+	recorder := new(stateRecorder)
+	rc := DialReconnecting("tcp@"+addr, nil, &ReconnectOption{
+		MinBackoff: time.Millisecond * 20,
+		MaxBackoff: time.Millisecond * 100,
+		Policy: QueueWhenDisconnected,
+		OnStateChange: recorder.record,
+	})
+	config := &Config{updates: make(chan string, 2)}
+	_assert(rc.Register(config) == nil, "failed to register the client service")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	var sum int
+	err := rc.Call(ctx, "Baz.Sum", &BazArgs{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "failed to call before restart: %v", err)
+	old, _ := rc.Client(ctx)
+
+	_ = server.Shutdown(context.Background())
+	for rc.State() == StateReady {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// 重连协程丢弃旧连接之前已经将其关闭
+	_assert(errors.Is(old.Close(), ErrShutdown), "expect the old connection to be closed")
+
+	// 重连期间的调用等待连接可用
+	done := make(chan error, 1)
+	go func() {
+		var sum int
+		err := rc.Call(ctx, "Baz.Sum", &BazArgs{Num1: 2, Num2: 3}, &sum)
+		if err == nil && sum != 5 {
+			err = errors.New("wrong sum")
+		}
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 200)
+	select {
+	case err := <-done:
+		t.Fatalf("expect the call to wait for the server, got %v", err)
+	default:
+	}
+
+	startReconnectServer(addr)
+	_assert(<-done == nil, "expect the queued call to succeed after restart")
+	var reply int
+	err = rc.Call(ctx, "Hub.Subscribe", "again", &reply)
+	_assert(err == nil && <-config.updates == "welcome again", "expect the client service on the new connection: %v", err)
+
+	_ = rc.Close()
+	states := recorder.String()
+	_assert(strings.HasPrefix(states, "connecting,ready,transient failure,connecting,") &&
+		strings.HasSuffix(states, "connecting,ready,shutdown"), "unexpected state changes: %s", states)
+	_assert(errors.Is(rc.Call(ctx, "Baz.Sum", &BazArgs{}, &sum), ErrShutdown), "expect ErrShutdown after close")
+}
+
+// Policy 为 FailWhenDisconnected 时，连接不可用期间的调用直接失败
+func TestReconnectingClient_Fail(t *testing.T) {
+	t.Parallel()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	rc := DialReconnecting("tcp@"+addr, nil, &ReconnectOption{MinBackoff: time.Millisecond * 20})
+	defer func() { _ = rc.Close() }()
+	var sum int
+	err := rc.Call(context.Background(), "Baz.Sum", &BazArgs{Num1: 1, Num2: 2}, &sum)
+	_assert(errors.Is(err, ErrDisconnected) && CodeOf(err) == CodeUnavailable, "expect ErrDisconnected, got %v", err)
+	_assert(!errors.Is(errShuttingDown, ErrDisconnected), "expect other unavailable errors not to match ErrDisconnected")
+
+	startReconnectServer(addr)
+	for rc.State() != StateReady {
+		time.Sleep(time.Millisecond * 10)
+	}
+	err = rc.Call(context.Background(), "Baz.Sum", &BazArgs{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "expect the call to succeed once connected: %v", err)
+}
+
+// 回调依次调用，Close 等待正在进行的回调返回，StateShutdown 总是最后一个
+func TestReconnectingClient_StateOrder(t *testing.T) {
+	t.Parallel()
+	_, addr := startReconnectServer("127.0.0.1:0")
+	recorder := new(stateRecorder)
+	ready := make(chan struct{})
+	rc := DialReconnecting("tcp@"+addr, nil, &ReconnectOption{
+		OnStateChange: func(state ConnState) {
+			if state == StateReady {
+				close(ready)
+				time.Sleep(time.Millisecond * 100)
+			}
+			recorder.record(state)
+		},
+	})
+	<-ready
+	_ = rc.Close()
+	states := recorder.String()
+	_assert(states == "connecting,ready,shutdown", "unexpected state changes: %s", states)
+}
@@ -1,7 +1,8 @@
 package violifer
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -9,8 +10,11 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	runtimedebug "runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"violifer/codec"
 )
@@ -27,6 +31,18 @@ type Option struct {
 	ConnectTimeout time.Duration
 	// 处理超时时间，默认值为 0， 即不设限
 	HandleTimeout time.Duration
+	// 消息体的压缩方式，默认不压缩
+	CompressType codec.CompressType
+	// 压缩阈值，编码后小于该长度的消息体不压缩，默认为 codec.DefaultCompressThreshold
+	CompressThreshold int
+	// 客户端拦截器，只在客户端使用，不参与握手
+	Interceptors []ClientInterceptor `json:"-"`
+	// 客户端服务端流式调用的接收窗口，单位为帧，0 表示使用 DefaultStreamWindow
+	StreamWindow int `json:"-"`
+	// 客户端的 TLS 配置，不为 nil 时使用 TLS 连接服务端，不参与握手
+	TLSConfig *tls.Config `json:"-"`
+	// 客户端的认证凭据，服务端要求认证时使用，不参与握手
+	Credentials Credentials `json:"-"`
 }
 
 // 默认协议信息
@@ -37,36 +53,82 @@ var DefaultOption = &Option {
 }
 
 /*
-RPC 客户端固定采用 JSON 编码 Option，后续的 header 和 body 的编码方式由 Option 中的 CodeType 指定，
-服务端首先使用 JSON 解码 Option，然后通过 Option 得 CodeType 解码剩余的内容。
+连接建立后，客户端与服务端首先通过握手帧协商 Option（见 handshake.go），
+后续的 header 和 body 的编码方式由 Option 中的 CodeType 指定。
 
 即报文将以这样的形式发送：
-| Option{MagicNumber: xxx, CodecType: xxx} | Header{ServiceMethod ...} | Body interface{} |
-| <------      固定 JSON 编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
+| 握手帧 {magic, version, Option} | Header{ServiceMethod ...} | Body interface{} |
+| <------   长度前缀 + JSON   ------> | <-------   编码方式由 CodeType 决定   ------->|
 
-在一次连接中，Option 固定在报文的最开始，Header 和 Body 可以有多个，即报文可能是这样的
-| Option | Header1 | Body1 | Header2 | Body2 | ...
+在一次连接中，握手帧固定在报文的最开始，Header 和 Body 可以有多个，即报文可能是这样的
+| 握手帧 | Header1 | Body1 | Header2 | Body2 | ...
  */
 
 // RPC Server
 type Server struct {
 	serviceMap sync.Map
+	mutex sync.Mutex
+	// 服务端拦截器，按照添加的顺序执行
+	interceptors []ServerInterceptor
+	// 记录服务方法 panic 的堆栈信息
+	logger Logger
+	// 正在监听的 listener 和正在服务的连接，关闭服务端时使用
+	listeners map[net.Listener]struct{}
+	conns map[*Peer]struct{}
+	// 正在处理的请求数
+	activeRequests int
+	// 服务端正在关闭，不再接收新的连接和请求
+	shuttingDown bool
+	// 合并同一连接上响应的刷新
+	coalesceFlush bool
+	// 握手时认证客户端，为 nil 时不需要认证
+	authenticator Authenticator
+	// 授权策略，为 nil 时不检查权限
+	policy *Policy
+	// 握手和认证阶段的时间限制，0 表示不限制
+	handshakeTimeout time.Duration
+}
+
+// 日志接口，*log.Logger 实现了该接口
+type Logger interface {
+	Printf(format string, v ...interface{})
 }
 
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		logger: log.Default(),
+		listeners: make(map[net.Listener]struct{}),
+		conns: make(map[*Peer]struct{}),
+		handshakeTimeout: DefaultOption.ConnectTimeout,
+	}
+}
+
+// 设置记录服务方法 panic 堆栈信息的日志
+func (server *Server) SetLogger(logger Logger) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.logger = logger
 }
 
 // 默认 Server 实例
 var DefaultServer = NewServer()
 
-// 使 listener 接收每一个进来的连接和服务请求
+// 使 listener 接收每一个进来的连接和服务请求，服务端关闭时返回
 func (server *Server) Accept(listener net.Listener) {
+	if !server.trackListener(listener, true) {
+		_ = listener.Close()
+		return
+	}
+	defer server.trackListener(listener, false)
+
 	for {
 		// 等待 socket 建立连接
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			if !server.isShuttingDown() {
+				log.Println("rpc server: accept error:", err)
+			}
 			return
 		}
 
@@ -79,43 +141,253 @@ func Accept (listener net.Listener) {
 	DefaultServer.Accept(listener)
 }
 
+// 检查服务端是否正在关闭
+func (server *Server) isShuttingDown() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.shuttingDown
+}
+
+// 添加或移除 listener，服务端正在关闭时不能添加
+func (server *Server) trackListener(listener net.Listener, add bool) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if !add {
+		delete(server.listeners, listener)
+		return true
+	}
+	if server.shuttingDown {
+		return false
+	}
+	server.listeners[listener] = struct{}{}
+	return true
+}
+
+// 添加或移除连接，服务端正在关闭时不能添加
+func (server *Server) trackConn(sc *Peer, add bool) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if !add {
+		delete(server.conns, sc)
+		return true
+	}
+	if server.shuttingDown {
+		return false
+	}
+	server.conns[sc] = struct{}{}
+	return true
+}
+
+// 开始处理一个请求，服务端正在关闭时返回 false
+func (server *Server) startRequest() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.shuttingDown {
+		return false
+	}
+	server.activeRequests++
+	return true
+}
+
+// 请求处理完成
+func (server *Server) finishRequest() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.activeRequests--
+}
+
+// 检查 Shutdown 时正在处理的请求是否全部完成的周期
+const shutdownPollInterval = time.Millisecond * 50
+
+// Shutdown 优雅地关闭服务端：
+// 1. 关闭所有 listener，不再接收新的连接
+// 2. 向所有连接发送 goaway 消息，通知客户端不再发送新的请求，之后到达的请求直接返回错误
+// 3. 等待正在处理的请求全部完成，或者 ctx 结束
+// 4. 关闭所有连接的编解码器
+// ctx 先结束时返回 ctx.Err()，正在处理的请求的 ctx 会被取消
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mutex.Lock()
+	server.shuttingDown = true
+	for listener := range server.listeners {
+		_ = listener.Close()
+	}
+	conns := make([]*Peer, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mutex.Unlock()
+
+	for _, sc := range conns {
+		server.sendResponse(sc.cc, &codec.Header{Type: codec.MsgGoAway}, invalidRequest, sc.sendingMutex)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	var err error
+	for {
+		server.mutex.Lock()
+		idle := server.activeRequests == 0
+		server.mutex.Unlock()
+		if idle {
+			break
+		}
+
+		select {
+		case <- ctx.Done():
+			err = ctx.Err()
+		case <- ticker.C:
+			continue
+		}
+		break
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for sc := range server.conns {
+		_ = sc.cc.Close()
+	}
+	return err
+}
+
+// 优雅地关闭默认 Server
+func Shutdown(ctx context.Context) error {
+	return DefaultServer.Shutdown(ctx)
+}
+
 // 处理连接得到编解码器
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() {
 		_ = conn.Close()
 	}()
 
-	var opt Option
-	// json 反序列化 option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Println("rpc server - options error:", err)
+	// TLS 握手、握手帧和认证都需要在时间限制内完成，不发送握手帧或不回应质询的连接不会一直占用协程
+	server.mutex.Lock()
+	timeout := server.handshakeTimeout
+	server.mutex.Unlock()
+	dc, limited := conn.(interface{ SetDeadline(t time.Time) error })
+	limited = limited && timeout > 0
+	if limited {
+		_ = dc.SetDeadline(time.Now().Add(timeout))
+	}
+
+	// TLS 连接先完成 TLS 握手，得到客户端证书
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Println("rpc server - tls handshake error:", err)
+			return
+		}
+	}
+
+	// 读取握手帧，握手帧有明确的长度，不会读取之后的 header 和 body
+	req, err := readHandshake(conn)
+	if err != nil {
+		log.Println("rpc server - handshake error:", err)
+		var verr *VersionError
+		if errors.As(err, &verr) {
+			_ = writeAck(conn, handshakeVersionMismatch, &handshakeAck{Error: err.Error()})
+		}
 		return
 	}
+	opt := req.Option
 
-	// 检查 MagicNumber 和 CodecType 是否正确
+	// 检查 MagicNumber 是否正确
 	if opt.MagicNumber != MagicNumber {
 		log.Printf("rpc server - invalid magic number %x", opt.MagicNumber)
+		_ = writeAck(conn, handshakeRejected, &handshakeAck{Error: "invalid magic number"})
 		return
 	}
-	// 由 CodecType 得到对应的编解码器
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		log.Printf("rpc server - invalid codec type %s", opt.CodecType)
+
+	// 由 CodecType 和 CompressType 得到对应的编解码器
+	cc, err := newCodec(conn, opt)
+	if err != nil {
+		log.Println("rpc server -", err)
+		_ = writeAck(conn, handshakeRejected, &handshakeAck{Error: err.Error()})
+		return
+	}
+
+	// 认证客户端，未通过认证的连接不进入编解码阶段
+	principal, err := server.authenticate(conn, req.AuthScheme)
+	if err != nil {
+		log.Println("rpc server - authentication error:", err)
+		_ = writeAck(conn, handshakeUnauthenticated, &handshakeAck{Error: err.Error()})
 		return
 	}
 
+	// 回复协商后的 Option，附带服务端的幂等方法
+	if err := writeAck(conn, handshakeOK, &handshakeAck{Option: opt, Idempotent: server.idempotentMethods()}); err != nil {
+		log.Println("rpc server - handshake ack error:", err)
+		return
+	}
+
+	// 握手完成，清除时间限制，之后的请求不受影响
+	if limited {
+		_ = dc.SetDeadline(time.Time{})
+	}
+
 	// 根据对应编解码器处理请求
-	server.serveCodec(f(conn), &opt)
+	server.serveCodec(conn, cc, opt, principal)
+}
+
+// 根据 Option 创建编解码器，协商了压缩方式时使用 CompressCodec 包装
+func newCodec(conn io.ReadWriteCloser, opt *Option) (codec.Codec, error) {
+	f := codec.NewCodecFuncMap[opt.CodecType]
+	if f == nil {
+		return nil, fmt.Errorf("invalid codec type %s", opt.CodecType)
+	}
+	if opt.CompressType == codec.CompressNone {
+		return f(conn), nil
+	}
+
+	compressor := codec.CompressorMap[opt.CompressType]
+	if compressor == nil {
+		return nil, fmt.Errorf("invalid compress type %s", opt.CompressType)
+	}
+	return codec.NewCompressCodec(f(conn), compressor, opt.CompressThreshold)
 }
 
 var invalidRequest = struct{}{}
 
+var errShuttingDown = NewError(CodeUnavailable, "rpc server - server is shutting down")
+
 // 请求处理（读取、处理、响应）
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
+func (server *Server) serveCodec(conn io.ReadWriteCloser, cc codec.Codec, opt *Option, principal *Principal) {
 	// 处理请求是并发的，必须确保回复请求（加锁）发送一个完整响应报文（并发会导致报文交叉，无法解析）
 	sendingMutex := new(sync.Mutex)
+	server.mutex.Lock()
+	coalesceFlush := server.coalesceFlush
+	server.mutex.Unlock()
+	if bw, ok := cc.(codec.BatchWriter); ok && coalesceFlush {
+		cc = newCoalescingCodec(cc, bw)
+	}
 	// 等待直到所有请求都被处理
 	wg := new(sync.WaitGroup)
+	// 连接断开时取消，通知正在处理的请求停止执行
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 正在处理的请求，序列号为键，收到客户端的取消消息时取消对应请求的 ctx
+	inflight := new(sync.Map)
+	// 正在处理的流式请求，序列号为键，收到客户端的窗口更新时通知对应的流
+	streams := new(sync.Map)
+
+	// 记录连接，服务端正在关闭时直接关闭连接
+	peer := newPeer(conn, cc, sendingMutex)
+	if principal == nil {
+		// 没有设置认证方式时，使用经过验证的客户端证书作为客户端身份
+		principal = peer.certificatePrincipal()
+	}
+	peer.principal = principal
+	if !server.trackConn(peer, true) {
+		_ = cc.Close()
+		return
+	}
+	defer server.trackConn(peer, false)
+	// 服务方法可以通过 ctx 得到连接对应的 Peer
+	ctx = context.WithValue(ctx, peerKey{}, peer)
 
 	// 在一次连接中，允许接收多个请求，即多个 request header 和 request body
 	for {
@@ -126,19 +398,106 @@ func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
 				// 解析失败，关闭连接
 				break
 			}
-			req.h.Error = err.Error()
+			setHeaderError(req.h, err)
 			// 回复错误信息
-			server.sendResponse(cc, req.h, invalidRequest, sendingMutex)
+			server.sendReply(cc, req, invalidRequest, sendingMutex)
+			continue
+		}
+		if req.h.Type == codec.MsgCancel {
+			if reqCancel, ok := inflight.Load(req.h.Seq); ok {
+				reqCancel.(context.CancelFunc)()
+			}
+			continue
+		}
+		if req.h.Type == codec.MsgWindowUpdate {
+			if s, ok := streams.Load(req.h.Seq); ok {
+				s.(*serverStream).updateWindow(req.h.Window)
+			}
+			continue
+		}
+		if req.h.Type == codec.MsgStream {
+			// 双向流中客户端发送的数据帧
+			server.readStreamBody(cc, req.h, streams)
+			continue
+		}
+		if req.h.Type == codec.MsgCallbackReply {
+			// 客户端对回调请求的响应
+			peer.receive(req.h)
+			continue
+		}
+		if req.h.Type == codec.MsgStreamEnd {
+			// 客户端结束发送
+			if s, ok := streams.Load(req.h.Seq); ok && s.(*serverStream).recvType != nil {
+				s.(*serverStream).closeRecv()
+			}
 			continue
 		}
+		if err := server.authorize(principal, req.h.ServiceMethod); err != nil {
+			// 没有权限，不调用服务方法
+			setHeaderError(req.h, err)
+			server.sendReply(cc, req, invalidRequest, sendingMutex)
+			continue
+		}
+		if !server.startRequest() {
+			// 已经发送过 goaway，客户端在收到之前发出的请求直接返回错误
+			setHeaderError(req.h, errShuttingDown)
+			server.sendReply(cc, req, invalidRequest, sendingMutex)
+			continue
+		}
+
+		if req.mtype.IsStream {
+			req.stream = newServerStream(cc, req.h, sendingMutex, req.mtype.RecvType)
+			req.replyv = req.mtype.newStreamv(req.stream)
+			streams.Store(req.h.Seq, req.stream)
+			if req.mtype.RecvType != nil {
+				// 双向流告知客户端服务端的接收窗口，客户端收到之后才能发送数据
+				req.stream.grantWindow(DefaultStreamWindow)
+			} else {
+				// 服务端流告知客户端不接收数据，客户端的 Send 不会一直等待窗口
+				req.stream.grantWindow(0)
+			}
+		}
+
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		if req.h.Type != codec.MsgNotify {
+			// 通知的 Seq 都为 0，客户端也不会取消通知
+			inflight.Store(req.h.Seq, reqCancel)
+		}
 		wg.Add(1)
 		// 并发处理请求
-		go server.handleRequest(cc, req, sendingMutex, wg, opt.HandleTimeout)
+		go func(req *request) {
+			seq := req.h.Seq
+			server.handleRequest(reqCtx, cc, req, sendingMutex, wg, opt.HandleTimeout)
+			if req.h.Type != codec.MsgNotify {
+				inflight.Delete(seq)
+				streams.Delete(seq)
+			}
+			reqCancel()
+			server.finishRequest()
+		}(req)
 	}
+	cancel()
+	peer.terminate()
 	wg.Wait()
 	_ = cc.Close()
 }
 
+// 读取双向流中客户端发送的一帧数据，交给 Seq 对应的流，流不存在时丢弃
+func (server *Server) readStreamBody(cc codec.Codec, h *codec.Header, streams *sync.Map) {
+	si, ok := streams.Load(h.Seq)
+	if !ok || si.(*serverStream).recvType == nil {
+		_ = cc.ReadBody(nil)
+		return
+	}
+	s := si.(*serverStream)
+	item, body := newStreamItem(s.recvType)
+	if err := cc.ReadBody(body); err != nil {
+		log.Println("rpc server - read stream body err: ", err)
+		return
+	}
+	s.push(item())
+}
+
 // 封装一个请求的所有信息 header 和 argv/replyv 组成的 body
 type request struct {
 	// 请求 header
@@ -151,6 +510,8 @@ type request struct {
 	mtype *methodType
 	// service 实例
 	svc *service
+	// 服务端流式方法的流，普通方法为 nil
+	stream *serverStream
 }
 
 // 读取请求 header
@@ -173,15 +534,42 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		return nil, err
 	}
 
+	switch h.Type {
+	case codec.MsgCancel, codec.MsgWindowUpdate, codec.MsgStreamEnd:
+		// 控制消息只有 header，丢弃空的 body
+		return &request{h: h}, cc.ReadBody(nil)
+	case codec.MsgStream, codec.MsgCallbackReply:
+		// 流的数据帧和回调的响应需要根据 Seq 找到对应的流或回调才能解码，body 由调用方读取
+		return &request{h: h}, nil
+	}
+	return server.readRequestBody(cc, h)
+}
+
+// 根据已经读取的 header 查找服务方法，读取 body 中的请求参数
+// 客户端处理服务端的回调请求时也使用该方法
+func (server *Server) readRequestBody(cc codec.Codec, h *codec.Header) (*request, error) {
+	var err error
 	req := &request{h: h}
 	// 将传入的 service 和 method 反射
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		// 丢弃请求的 body，保证后续报文能够被正确解析
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
-	// 分别创建两个入参实例：参数实例、返回值实例
+	// 流式调用在请求中携带初始窗口，调用方式必须与方法的类型一致
+	if req.mtype.IsStream != (h.Window != 0) {
+		_ = cc.ReadBody(nil)
+		if req.mtype.IsStream {
+			return req, NewError(CodeInvalidArgument, "rpc server - " + h.ServiceMethod + " is a stream method, use Client.Stream")
+		}
+		return req, NewError(CodeInvalidArgument, "rpc server - " + h.ServiceMethod + " is not a stream method, use Client.Call")
+	}
+	// 分别创建两个入参实例：参数实例、返回值实例，流式方法的 stream 参数在开始处理时创建
 	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReplyv()
+	if !req.mtype.IsStream {
+		req.replyv = req.mtype.newReplyv()
+	}
 
 	argvi := req.argv.Interface()
 	if req.argv.Type().Kind() != reflect.Ptr {
@@ -192,7 +580,15 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	// 通过 ReadBody 将请求报文反序列化为第一个入参 argvi
 	if err = cc.ReadBody(argvi); err != nil {
 		log.Println("rpc server - read body err: ", err)
-		return req, err
+		return req, NewError(CodeCodec, err.Error())
+	}
+
+	// 编解码器对返回值类型有要求时，在调用方法之前检查，避免方法执行后无法发送响应
+	if bc, ok := cc.(codec.BodyChecker); ok && !req.mtype.IsStream {
+		if err = bc.CheckBody(req.replyv.Interface()); err != nil {
+			log.Printf("rpc server - %s reply type error: %v", h.ServiceMethod, err)
+			return req, NewError(CodeCodec, err.Error())
+		}
 	}
 
 	return req, nil
@@ -201,59 +597,174 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 // 发送响应
 func (server *Server) sendResponse(cc codec.Codec, h *codec.Header,
 		body interface{}, sendingMutex *sync.Mutex) {
+	// 开启了合并刷新时，登记正在等待发送的响应
+	c, coalescing := cc.(*coalescingCodec)
+	if coalescing {
+		atomic.AddInt32(&c.waiting, 1)
+	}
 	sendingMutex.Lock()
 	defer sendingMutex.Unlock()
+	if coalescing {
+		atomic.AddInt32(&c.waiting, -1)
+	}
 
 	if err := cc.Write(h, body); err != nil {
 		log.Println("rpc server - write response error:", err)
 	}
 }
 
+// 发送请求的最终响应，流式方法发送结束帧，单向通知不发送响应，只记录错误
+func (server *Server) sendReply(cc codec.Codec, req *request,
+		body interface{}, sendingMutex *sync.Mutex) {
+	if req.h.Type == codec.MsgNotify {
+		if req.h.Error != "" {
+			log.Printf("rpc server - notification %s error: %s", req.h.ServiceMethod, req.h.Error)
+		}
+		return
+	}
+	if req.stream != nil {
+		req.stream.end(req.h)
+		return
+	}
+	server.sendResponse(cc, req.h, body, sendingMutex)
+}
+
 // 处理请求
-// 与客户端连接超时类似，使用 time.After() 结合 select + chan 完成服务端超时处理
-func (server *Server) handleRequest(cc codec.Codec, req *request,
+// 与客户端连接超时类似，使用 context 结合 select + chan 完成服务端超时处理
+// 服务端的 HandleTimeout 和客户端传递的截止时间取较早者，超时、客户端取消或连接断开时取消 ctx，
+// 接收 context.Context 的方法可以据此停止执行
+func (server *Server) handleRequest(ctx context.Context, cc codec.Codec, req *request,
 		sendingMutex *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
 	defer wg.Done()
 
+	var deadline time.Time
+	timeoutMsg := fmt.Sprintf("rpc server - request handle timeout: expect within %s", timeout)
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if req.h.Timeout != 0 {
+		// 使用服务端的时钟计算调用方的截止时间
+		if d := time.Now().Add(time.Duration(req.h.Timeout)); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+			timeoutMsg = "rpc server - request handle timeout: client deadline exceeded"
+		}
+		// 响应不需要携带超时时间
+		req.h.Timeout = 0
+	}
+	req.h.Window = 0
+
+	// 请求元数据和响应元数据通过 ctx 传递给方法
+	ctx, respMD := newIncomingContext(ctx, Metadata(req.h.Metadata))
+
+	var cancel context.CancelFunc
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	if req.stream != nil {
+		req.stream.ctx = ctx
+	}
+
+	// 拦截器使用 header 的副本，超时后外层写入响应的 header 时，拦截器仍可能在执行
+	ih := *req.h
+	ih.Metadata = Metadata(req.h.Metadata).Copy()
+
 	// 为确保 sendResponse 仅调用一次，因此将整个过程拆分为 called 和 sent 两个阶段
 	called := make(chan struct{})
 	sent := make(chan struct{})
 
 	go func() {
-		// 调用注册的 rpc 方法得到返回值 replyv
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
+		// 经过拦截器链调用注册的 rpc 方法得到返回值 replyv
+		err := server.safeInvoke(ctx, req, &ih)
+		select {
+		case called <- struct{}{}:
+		case <- ctx.Done():
+			// 已经超时或被取消，响应由外层处理，直接退出
+			return
+		}
+		req.h.Metadata = respMD.get()
 		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sendingMutex)
+			setHeaderError(req.h, err)
+			server.sendReply(cc, req, invalidRequest, sendingMutex)
 			sent <- struct{}{}
 			return
 		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sendingMutex)
+		server.sendReply(cc, req, req.replyv.Interface(), sendingMutex)
 		sent <- struct{}{}
 	}()
 
-	if timeout == 0 {
-		<- called
-		<- sent
-		return
-	}
-
 	// called 信道接收到消息，代表处理没有超时，继续执行 sendResponse
-	// time.After() 先于 called 接收到消息，说明处理已经超时，called 和 sent 都将被阻塞
-	// 在 case <-time.After(timeout) 处调用 sendResponse
+	// ctx 先于 called 结束，说明处理已经超时或连接已经断开，方法的协程不会再发送响应
 	select {
-	case <- time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server - request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sendingMutex)
+	case <- ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			setHeaderError(req.h, NewError(CodeDeadlineExceeded, timeoutMsg))
+			req.h.Metadata = nil
+			server.sendReply(cc, req, invalidRequest, sendingMutex)
+		}
 	case <- called:
 		<- sent
 	}
 }
 
+// 调用方法并恢复 panic，panic 作为内部错误返回给调用方，保证 called 和 sent 能够正常发出
+func (server *Server) safeInvoke(ctx context.Context, req *request, h *codec.Header) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&req.mtype.numPanics, 1)
+			server.mutex.Lock()
+			logger := server.logger
+			server.mutex.Unlock()
+			logger.Printf("rpc server - panic in %s: %v\n%s", req.h.ServiceMethod, r, runtimedebug.Stack())
+			err = Errorf(CodeInternal, "rpc server - internal error: panic in %s: %v", req.h.ServiceMethod, r)
+		}
+	}()
+	return server.invoke(ctx, req, h)
+}
+
 // 注册 service
 func (server *Server) Register(rcvr interface{}) error {
+	return server.register(newService(rcvr))
+}
+
+// 注册 service，并将 methods 标记为幂等方法，methods 为空时标记所有方法
+// 幂等方法在握手时告知客户端，XClient 据此判断请求到达服务端之后失败能否重试
+func (server *Server) RegisterIdempotent(rcvr interface{}, methods ...string) error {
 	s := newService(rcvr)
+	if len(methods) == 0 {
+		for _, mtype := range s.method {
+			mtype.Idempotent = true
+		}
+	}
+	for _, name := range methods {
+		mtype := s.method[name]
+		if mtype == nil {
+			return errors.New("rpc - can't find method: " + s.name + "." + name)
+		}
+		mtype.Idempotent = true
+	}
+	return server.register(s)
+}
+
+// 返回所有幂等方法的 ServiceMethod，按字典序排列
+func (server *Server) idempotentMethods() []string {
+	var methods []string
+	server.serviceMap.Range(func(_, v interface{}) bool {
+		s := v.(*service)
+		for name, mtype := range s.method {
+			if mtype.Idempotent {
+				methods = append(methods, s.name + "." + name)
+			}
+		}
+		return true
+	})
+	sort.Strings(methods)
+	return methods
+}
+
+func (server *Server) register(s *service) error {
 	// LoadOrStore(key, value) 如果 key 存在，则返回 key 对应的元素
 	// 如果 key 不存在，则返回设置的 value，并将 value 存入 map 中
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
@@ -267,12 +778,17 @@ func Register(rcvr interface{}) error {
 	return DefaultServer.Register(rcvr)
 }
 
+// 默认 Server 注册 service，并标记幂等方法
+func RegisterIdempotent(rcvr interface{}, methods ...string) error {
+	return DefaultServer.RegisterIdempotent(rcvr, methods...)
+}
+
 // 通过 serviceMethod 从 serviceMap 中查找对应的 service
 func (server *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
 		// service.method 格式错误
-		err = errors.New("rpc server - service/method request ill-formed: " + serviceMethod)
+		err = NewError(CodeInvalidArgument, "rpc server - service/method request ill-formed: " + serviceMethod)
 		return
 	}
 
@@ -282,13 +798,14 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 	svci, ok := server.serviceMap.Load(serviceName)
 	if !ok {
 		// 加载失败，实例不存在
-		err = errors.New("rpc server - can't find service: " + serviceName)
+		err = NewError(CodeNotFound, "rpc server - can't find service: " + serviceName)
+		return
 	}
 	// 从 service 实例的 method 中，找到对应的 methodType
 	svc = svci.(*service)
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server - can't find method: " + methodName)
+		err = NewError(CodeNotFound, "rpc server - can't find method: " + methodName)
 	}
 	return
 }
@@ -0,0 +1,257 @@
+package violifer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"violifer/codec"
+)
+
+// 拦截器按照添加的顺序执行，并且可以中断请求
+func TestServer_Use(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var order []string
+	record := func(name string) ServerInterceptor {
+		return func(ctx context.Context, serviceMethod string, h *codec.Header,
+			argv, replyv interface{}, next ServerHandler) error {
+			mutex.Lock()
+			order = append(order, name+":"+serviceMethod)
+			mutex.Unlock()
+			return next(ctx, argv, replyv)
+		}
+	}
+	deny := func(ctx context.Context, serviceMethod string, h *codec.Header,
+		argv, replyv interface{}, next ServerHandler) error {
+		if serviceMethod == "Baz.Repeat" {
+			return errors.New("permission denied")
+		}
+		return next(ctx, argv, replyv)
+	}
+
+	server := NewServer()
+	_ = server.Register(new(Baz))
+	server.Use(record("first"), deny)
+	server.Use(record("second"))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	var sum int
+	err := client.Call(context.Background(), "Baz.Sum", &BazArgs{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "failed to call Baz.Sum through interceptors: %v", err)
+	var repeat string
+	err = client.Call(context.Background(), "Baz.Repeat", &BazArgs{Num1: 1}, &repeat)
+	_assert(err != nil && strings.Contains(err.Error(), "permission denied"), "expect the interceptor to reject Baz.Repeat")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	_assert(strings.Join(order, ",") == "first:Baz.Sum,second:Baz.Sum,first:Baz.Repeat",
+		"wrong interceptor order: %v", order)
+}
+
+// 请求超时后拦截器仍在执行，拦截器修改的是 header 的副本，不影响发送给客户端的超时响应
+func TestServer_InterceptorTimeout(t *testing.T) {
+	t.Parallel()
+	done := make(chan struct{})
+	server := NewServer()
+	_ = server.Register(new(Slow))
+	server.Use(func(ctx context.Context, serviceMethod string, h *codec.Header,
+		argv, replyv interface{}, next ServerHandler) error {
+		defer close(done)
+		err := next(context.Background(), argv, replyv)
+		h.Error = "overwritten by interceptor"
+		h.Metadata = map[string]string{"k": "v"}
+		return err
+	})
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String(), &Option{HandleTimeout: time.Millisecond * 50})
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call(context.Background(), "Slow.Sleep", 200, &reply)
+	_assert(CodeOf(err) == CodeDeadlineExceeded, "expect a deadline exceeded error, got %v", err)
+	<-done
+}
+
+type Boom int
+
+func (b Boom) Explode(args int, reply *int) error {
+	var m map[string]int
+	m["boom"] = args
+	return nil
+}
+
+// 记录日志内容
+type bufferLogger struct {
+	mutex sync.Mutex
+	logs  []string
+}
+
+func (l *bufferLogger) Printf(format string, v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+// 服务方法 panic 时返回内部错误，记录堆栈和 panic 次数，服务端继续正常工作
+func TestServer_PanicRecovery(t *testing.T) {
+	t.Parallel()
+	logger := new(bufferLogger)
+	server := NewServer()
+	server.SetLogger(logger)
+	_ = server.Register(new(Boom))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	for i := 0; i < 2; i++ {
+		err := client.Call(context.Background(), "Boom.Explode", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "internal error") &&
+			strings.Contains(err.Error(), "assignment to entry in nil map"), "expect an internal error, got %v", err)
+	}
+
+	svci, _ := server.serviceMap.Load("Boom")
+	mType := svci.(*service).method["Explode"]
+	_assert(mType.NumCalls() == 2 && mType.NumPanics() == 2, "expect 2 panics, got %d", mType.NumPanics())
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	_assert(len(logger.logs) == 2 && strings.Contains(logger.logs[0], "goroutine"), "expect the stack trace to be logged")
+}
+
+type Slow int
+
+// 等待 args 毫秒或者 ctx 结束
+func (s Slow) Sleep(ctx context.Context, args int, reply *int) error {
+	select {
+	case <-time.After(time.Duration(args) * time.Millisecond):
+		*reply = args
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown 等待正在处理的请求完成，之后的请求返回 ErrGoingAway，不再接收新的连接
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Slow))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Slow.Sleep", 300, &reply, nil)
+	time.Sleep(time.Millisecond * 100)
+
+	err := server.Shutdown(context.Background())
+	_assert(err == nil, "failed to shutdown: %v", err)
+	<-call.Done
+	_assert(call.Error == nil && reply == 300, "expect the in-flight call to complete: %v", call.Error)
+
+	err = client.Call(context.Background(), "Slow.Sleep", 1, &reply)
+	_assert(errors.Is(err, ErrGoingAway) || errors.Is(err, ErrShutdown), "expect the client to stop sending requests, got %v", err)
+	_assert(!client.IsAvailable(), "expect the client to be unavailable")
+	_, err = net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	_assert(err != nil, "expect the listener to be closed")
+}
+
+// ctx 先结束时 Shutdown 返回 ctx.Err()，并取消正在处理的请求
+func TestServer_ShutdownTimeout(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Slow))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Slow.Sleep", 10000, &reply, nil)
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	_assert(errors.Is(err, context.DeadlineExceeded), "expect the shutdown to time out, got %v", err)
+	select {
+	case <-call.Done:
+		_assert(call.Error != nil, "expect the in-flight call to fail")
+	case <-time.After(time.Second):
+		t.Fatal("expect the in-flight call to be terminated")
+	}
+}
+
+// 没有在时间限制内完成握手或认证的连接被关闭，握手完成后不再受时间限制
+func TestServer_HandshakeTimeout(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Slow))
+	server.SetHandshakeTimeout(time.Millisecond * 100)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	// 连接关闭时 io.ReadAll 返回 nil，超过客户端自己的截止时间时返回超时错误
+	expectClosed := func(conn net.Conn, stage string) {
+		_ = conn.SetDeadline(time.Now().Add(time.Second * 2))
+		_, err := io.ReadAll(conn)
+		_assert(err == nil, "expect the connection to be closed %s, got %v", stage, err)
+	}
+	t.Run("no handshake", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		expectClosed(conn, "without a handshake")
+	})
+	t.Run("no tls handshake", func(t *testing.T) {
+		_, _, cert := issueCert("server", nil, nil, 1)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer func() { _ = l.Close() }()
+		go server.AcceptTLS(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		expectClosed(conn, "without a tls handshake")
+	})
+	t.Run("no response to challenge", func(t *testing.T) {
+		authed := NewServer()
+		authed.SetHandshakeTimeout(time.Millisecond * 100)
+		authed.SetAuthenticator(NewBearerAuthenticator(func(token string) (string, error) {
+			return token, nil
+		}))
+		l, _ := net.Listen("tcp", ":0")
+		defer func() { _ = l.Close() }()
+		go authed.Accept(l)
+
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		_ = writeHandshake(conn, &handshakeRequest{Option: DefaultOption, AuthScheme: SchemeBearer})
+		expectClosed(conn, "without a response to the challenge")
+	})
+	t.Run("after handshake", func(t *testing.T) {
+		client, err := Dial("tcp", l.Addr().String())
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+		time.Sleep(time.Millisecond * 200)
+		var reply int
+		err = client.Call(context.Background(), "Slow.Sleep", 1, &reply)
+		_assert(err == nil && reply == 1, "expect the connection to outlive the handshake timeout: %v", err)
+	})
+}
@@ -1,6 +1,7 @@
 package violifer
 
 import (
+	"context"
 	"go/ast"
 	"log"
 	"reflect"
@@ -12,21 +13,38 @@ import (
 
 // methodType 实例包含了一个方法的完整信息
 // func (t *T) MethodName(argType T1, replyType *T2) error
+// func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+// func (t *T) MethodName(argType T1, stream *ServerStream[T2]) error
+// func (t *T) MethodName(argType T1, stream *BidiStream[T2, T3]) error
 type methodType struct {
 	// 方法本身实例
 	method reflect.Method
+	// 第一个参数是否为 context.Context
+	HasContext bool
 	// 第一个参数（参数 Type）
 	ArgType reflect.Type
-	// 第二个参数（返回值 Type）
+	// 第二个参数（返回值 Type），流式方法为 *ServerStream[T2] 或 *BidiStream[T2, T3]
 	ReplyType reflect.Type
+	// 是否为流式方法
+	IsStream bool
+	// 双向流式方法中客户端发送的数据类型，其他方法为 nil
+	RecvType reflect.Type
+	// 是否为幂等方法，通过 Server.RegisterIdempotent 标记
+	Idempotent bool
 	// 统计方法调用次数
 	numCalls uint64
+	// 统计方法 panic 次数
+	numPanics uint64
 }
 
 func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *methodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
 // 创建参数实例
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
@@ -55,6 +73,16 @@ func (m *methodType) newReplyv() reflect.Value {
 	return replyv
 }
 
+// 创建流式方法的 stream 参数实例
+func (m *methodType) newStreamv(s *serverStream) reflect.Value {
+	streamv := reflect.New(m.ReplyType.Elem())
+	streamv.Interface().(streamSender).setStream(s)
+	return streamv
+}
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // 服务
 type service struct {
 	// 映射的结构体名称，T
@@ -90,29 +118,43 @@ func (s *service) registerMethods() {
 		method := s.typ.Method(i)
 		mType := method.Type
 
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if (mType.NumIn() != 3 && mType.NumIn() != 4) || mType.NumOut() != 1 {
 			// 两个导出或内置类型的入参，反射时为 3 个，第 0 个是自身
 			// 类似于 python 的 self，java 中的 this
+			// 第一个参数为 context.Context 时，反射时为 4 个
 			// 返回值有且只有 1 个，类型为 error
 			continue
 		}
 
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		hasContext := mType.NumIn() == 4
+		if hasContext && mType.In(1) != typeOfContext {
+			// 3 个参数时，第一个参数必须为 context.Context
+			continue
+		}
+
+		if mType.Out(0) != typeOfError {
 			// 返回值类型必须为 error
 			continue
 		}
 
-		argType, replyType := mType.In(1), mType.In(2)
+		argType, replyType := mType.In(mType.NumIn() - 2), mType.In(mType.NumIn() - 1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			// 参数和返回值必须是可导出的
 			continue
 		}
 
-		s.method[method.Name] = &methodType {
+		mt := &methodType {
 			method: method,
+			HasContext: hasContext,
 			ArgType: argType,
 			ReplyType: replyType,
+			// 最后一个参数为 *ServerStream[T2] 或 *BidiStream[T2, T3] 时是流式方法
+			IsStream: replyType.Implements(typeOfStreamSender),
 		}
+		if mt.IsStream && replyType.Implements(typeOfStreamReceiver) {
+			mt.RecvType = reflect.New(replyType.Elem()).Interface().(streamReceiver).recvType()
+		}
+		s.method[method.Name] = mt
 		log.Printf("rpc server - register %s.%s\n", s.name, method.Name)
 	}
 }
@@ -122,15 +164,19 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-// 通过反射值调用方法
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+// 通过反射值调用方法，方法接收 context.Context 时传入 ctx
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	// Func Value 表示方法的值
 	f := m.method.Func
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.HasContext {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
 	// func (v Value) Call(in []Value) []Value
 	// Call 方法使用输入的参数 in 调用 v 持有的函数，如果 v 的 Kind 不是 Func 会 panic
 	// 返回函数所有输出结果的 Value 封装的切片
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	returnValues := f.Call(in)
 	// func (v Value) Interface() (i interface{})
 	// 返回 v 当前持有的值（表示为/保管在 interface{} 类型）
 	if errInter := returnValues[0].Interface(); errInter != nil {
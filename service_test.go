@@ -1,6 +1,7 @@
 package violifer
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
@@ -31,6 +32,35 @@ func _assert(condition bool, msg string, v ...interface{}) {
 	}
 }
 
+type Qux int
+
+func (q Qux) Sum(ctx context.Context, args Args, reply *int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	*reply = args.num1 + args.num2
+	return nil
+}
+
+// 第一个参数为 context.Context 的方法同样可以注册和调用
+func TestMethodType_CallWithContext(t *testing.T) {
+	var qux Qux
+	s := newService(&qux)
+	mType := s.method["Sum"]
+	_assert(mType != nil && mType.HasContext, "wrong Method, Sum should accept context")
+
+	argv := mType.newArgv()
+	replyv := mType.newReplyv()
+	argv.Set(reflect.ValueOf(Args{num1: 1, num2: 3}))
+	err := s.call(context.Background(), mType, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*int) == 4, "failed to call Qux.Sum")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.call(ctx, mType, argv, replyv)
+	_assert(err == context.Canceled, "expect Qux.Sum to see the canceled context")
+}
+
 // 测试 newService 方法
 func TestNewService(t *testing.T) {
 	var foo Foo
@@ -49,6 +79,6 @@ func TestMethodType_Call(t *testing.T) {
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{num1: 1, num2: 3}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
\ No newline at end of file
@@ -0,0 +1,517 @@
+package violifer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"violifer/codec"
+)
+
+// 流式调用
+// 服务端流式方法需要满足如下格式，方法每调用一次 stream.Send 向客户端发送一帧数据，方法返回后流结束
+// func (t *T) MethodName(argType T1, stream *ServerStream[T2]) error
+// func (t *T) MethodName(ctx context.Context, argType T1, stream *ServerStream[T2]) error
+// 双向流式方法还可以通过 stream.Recv 读取客户端发送的数据，客户端流式（上传）是它的特例
+// func (t *T) MethodName(argType T1, stream *BidiStream[T2, T3]) error
+// 客户端通过 Client.Stream 发起调用，通过 ClientStream.Recv 依次读取每一帧数据，
+// 双向流式调用中通过 ClientStream.Send 发送数据，通过 ClientStream.CloseSend 结束发送
+//
+// 同一个流的所有帧使用相同的 Seq，数据帧为 MsgStream，服务端发送 MsgStreamEnd 结束整个流，
+// 客户端发送 MsgStreamEnd 只结束客户端到服务端方向的发送
+// 流控以帧为单位，两个方向各自独立：接收方的缓冲区等于窗口，发送方的未确认帧数不超过窗口，
+// 接收方每处理一批数据后发送 MsgWindowUpdate 归还窗口，窗口用完时发送方阻塞，
+// 因此连接的读协程不会因为某个流处理慢而阻塞，其他调用不受影响
+// 客户端的接收窗口在请求中携带，服务端的接收窗口在开始处理双向流时通过 MsgWindowUpdate 告知客户端，
+// 服务端流开始处理时发送窗口为 0 的 MsgWindowUpdate，告知客户端不接收数据，客户端的 Send 直接返回错误
+
+// 默认的流控窗口，单位为帧
+const DefaultStreamWindow = 32
+
+// 为类型 t 的一帧数据创建解码目标 body，解码完成后调用 item 得到类型为 t 的值
+// t 为指针类型时直接解码到新的实例，例如 protobuf 消息
+func newStreamItem(t reflect.Type) (item func() reflect.Value, body interface{}) {
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		return func() reflect.Value { return v }, v.Interface()
+	}
+	v := reflect.New(t)
+	return v.Elem, v.Interface()
+}
+
+// 读取了一半窗口的数据后归还窗口，避免每一帧都发送窗口更新
+func windowThreshold(window uint32) uint32 {
+	return (window + 1) / 2
+}
+
+// 服务端流的公共部分，与数据类型无关
+type serverStream struct {
+	ctx context.Context
+	cc codec.Codec
+	sendingMutex *sync.Mutex
+	seq uint64
+	serviceMethod string
+
+	// 保护 window、closed 和接收相关的状态
+	mutex sync.Mutex
+	// 剩余的发送窗口
+	window uint32
+	// 收到窗口更新时通知正在等待的 Send
+	windowUpdated chan struct{}
+	// 已经发送了结束帧，不能继续发送
+	closed bool
+
+	// 双向流中客户端发送的数据类型，服务端流为 nil
+	recvType reflect.Type
+	// 已经收到但还没有被读取的数据，容量等于接收窗口
+	items chan reflect.Value
+	// 已经读取但还没有归还的窗口
+	consumed uint32
+	// 客户端结束发送时关闭
+	recvEnd chan struct{}
+	recvClosed bool
+	// 流因为错误提前结束时关闭，之后 Send 和 Recv 返回 err
+	aborted chan struct{}
+	err error
+}
+
+func newServerStream(cc codec.Codec, h *codec.Header, sendingMutex *sync.Mutex, recvType reflect.Type) *serverStream {
+	s := &serverStream{
+		cc: cc,
+		sendingMutex: sendingMutex,
+		seq: h.Seq,
+		serviceMethod: h.ServiceMethod,
+		window: h.Window,
+		windowUpdated: make(chan struct{}, 1),
+		recvType: recvType,
+	}
+	if recvType != nil {
+		s.items = make(chan reflect.Value, DefaultStreamWindow)
+		s.recvEnd = make(chan struct{})
+		s.aborted = make(chan struct{})
+	}
+	return s
+}
+
+var errStreamClosed = errors.New("rpc server - stream is closed")
+
+// 客户端发送的数据超过了服务端的接收窗口
+var errStreamWindowExceeded = NewError(CodeInvalidArgument, "rpc server - stream receive window exceeded")
+
+// 发送一帧数据，发送窗口用完时等待客户端归还窗口
+func (s *serverStream) send(body interface{}) error {
+	for {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			err := s.err
+			s.mutex.Unlock()
+			if err != nil {
+				return err
+			}
+			return errStreamClosed
+		}
+		if s.window > 0 {
+			s.window--
+			// 持有 s.mutex 发送，保证数据帧不会出现在结束帧之后
+			err := s.write(&codec.Header{ServiceMethod: s.serviceMethod, Seq: s.seq, Type: codec.MsgStream}, body)
+			s.mutex.Unlock()
+			return err
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <- s.windowUpdated:
+		case <- s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// 客户端归还了 n 帧的窗口
+func (s *serverStream) updateWindow(n uint32) {
+	s.mutex.Lock()
+	s.window += n
+	s.mutex.Unlock()
+
+	select {
+	case s.windowUpdated <- struct{}{}:
+	default:
+	}
+}
+
+// 发送结束帧，之后的 Send 返回错误
+func (s *serverStream) end(h *codec.Header) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	h.Type = codec.MsgStreamEnd
+	_ = s.write(h, invalidRequest)
+}
+
+func (s *serverStream) write(h *codec.Header, body interface{}) error {
+	s.sendingMutex.Lock()
+	defer s.sendingMutex.Unlock()
+
+	return s.cc.Write(h, body)
+}
+
+// 告知客户端服务端的接收窗口，流开始处理前调用，服务端流为 0
+func (s *serverStream) grantWindow(n uint32) {
+	h := &codec.Header{Seq: s.seq, Type: codec.MsgWindowUpdate, Window: n}
+	if err := s.write(h, invalidRequest); err != nil {
+		log.Println("rpc server - send window update error:", err)
+	}
+}
+
+// 接收客户端发送的一帧数据，由连接的读协程调用
+func (s *serverStream) push(v reflect.Value) {
+	select {
+	case <- s.aborted:
+		// 流已经因为错误结束，丢弃之后到达的数据
+		return
+	default:
+	}
+	select {
+	case s.items <- v:
+	default:
+		// 客户端没有遵守流控窗口，不阻塞连接的读协程，也不丢弃数据继续处理，而是以错误结束整个流
+		log.Printf("rpc server - %s stream receive window exceeded", s.serviceMethod)
+		s.abort(errStreamWindowExceeded)
+	}
+}
+
+// 发送带有错误的结束帧，提前结束整个流，方法之后的 Send 和 Recv 返回 err，方法的返回值不再发送
+func (s *serverStream) abort(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.aborted)
+	h := &codec.Header{ServiceMethod: s.serviceMethod, Seq: s.seq, Type: codec.MsgStreamEnd}
+	setHeaderError(h, err)
+	_ = s.write(h, invalidRequest)
+}
+
+// 客户端结束发送
+func (s *serverStream) closeRecv() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.recvClosed {
+		s.recvClosed = true
+		close(s.recvEnd)
+	}
+}
+
+// 读取客户端发送的下一帧数据，客户端结束发送后返回 io.EOF
+func (s *serverStream) recv() (reflect.Value, error) {
+	var v reflect.Value
+	select {
+	case v = <- s.items:
+	case <- s.recvEnd:
+		// 结束帧在所有数据帧之后到达，先读完缓冲中的数据
+		select {
+		case v = <- s.items:
+		default:
+			return v, io.EOF
+		}
+	case <- s.aborted:
+		return v, s.err
+	case <- s.ctx.Done():
+		return v, s.ctx.Err()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.consumed++
+	if s.consumed >= windowThreshold(DefaultStreamWindow) && !s.closed && !s.recvClosed {
+		h := &codec.Header{Seq: s.seq, Type: codec.MsgWindowUpdate, Window: s.consumed}
+		if err := s.write(h, invalidRequest); err != nil {
+			log.Println("rpc server - send window update error:", err)
+		}
+		s.consumed = 0
+	}
+	return v, nil
+}
+
+// 服务端流式方法的最后一个参数，用于向客户端发送类型为 T 的数据
+type ServerStream[T any] struct {
+	s *serverStream
+}
+
+// 服务端注册方法时，通过该接口识别流式方法
+type streamSender interface {
+	setStream(s *serverStream)
+}
+
+// 服务端注册方法时，通过该接口识别双向流式方法，并得到客户端发送的数据类型
+type streamReceiver interface {
+	recvType() reflect.Type
+}
+
+var typeOfStreamSender = reflect.TypeOf((*streamSender)(nil)).Elem()
+var typeOfStreamReceiver = reflect.TypeOf((*streamReceiver)(nil)).Elem()
+
+func (ss *ServerStream[T]) setStream(s *serverStream) {
+	ss.s = s
+}
+
+// 向客户端发送一帧数据，客户端的接收缓冲区满时阻塞，请求超时或被取消时返回错误
+func (ss *ServerStream[T]) Send(v T) error {
+	return ss.s.send(v)
+}
+
+// 返回流的 ctx，与接收 context.Context 的方法得到的 ctx 相同
+func (ss *ServerStream[T]) Context() context.Context {
+	return ss.s.ctx
+}
+
+// 双向流式方法的最后一个参数，用于接收客户端发送的类型为 Req 的数据，并向客户端发送类型为 Resp 的数据
+// Send 和 Recv 可以在不同的协程中同时调用
+type BidiStream[Req, Resp any] struct {
+	ServerStream[Resp]
+}
+
+func (bs *BidiStream[Req, Resp]) recvType() reflect.Type {
+	return reflect.TypeOf((*Req)(nil)).Elem()
+}
+
+// 读取客户端发送的下一帧数据，客户端调用 CloseSend 后返回 io.EOF，请求超时或被取消时返回错误
+func (bs *BidiStream[Req, Resp]) Recv() (Req, error) {
+	var req Req
+	v, err := bs.s.recv()
+	if err != nil {
+		return req, err
+	}
+	return v.Interface().(Req), nil
+}
+
+// 客户端的一次流式调用
+type ClientStream struct {
+	client *Client
+	call *Call
+	ctx context.Context
+	// 每一帧数据的类型
+	itemType reflect.Type
+	// 已经收到但还没有被读取的数据，容量等于流控窗口，服务端不会发送超过窗口的数据
+	items chan reflect.Value
+	window uint32
+	// 已经读取但还没有归还的窗口
+	consumed uint32
+	// 流结束时关闭
+	end chan struct{}
+	// 流结束的原因，end 关闭之后才能读取
+	err error
+	// 流因为 ctx 结束而关闭，不再返回缓冲中的数据
+	canceled bool
+
+	// 保护发送相关的状态
+	mutex sync.Mutex
+	// 剩余的发送窗口，由服务端通过 MsgWindowUpdate 告知
+	sendWindow uint32
+	// 收到窗口更新时通知正在等待的 Send
+	windowUpdated chan struct{}
+	// 已经调用了 CloseSend
+	sendClosed bool
+	// 服务端流式方法不接收客户端的数据，由服务端通过窗口为 0 的 MsgWindowUpdate 告知
+	sendRefused bool
+}
+
+// 发起流式调用，reply 为指向单帧数据类型的指针，例如 new(string)，只用于确定数据的类型
+// ctx 的截止时间和元数据与 Call 一样发送给服务端，ctx 被取消时流关闭，并通知服务端取消处理
+// 例如：
+// stream, err := client.Stream(ctx, "Foo.List", &Args{1, 2}, new(Item))
+// var item Item
+// for err = stream.Recv(&item); err == nil; err = stream.Recv(&item) {}
+// if err != io.EOF {...}
+func (client *Client) Stream(ctx context.Context, serviceMethod string, args, reply interface{}) (*ClientStream, error) {
+	replyType := reflect.TypeOf(reply)
+	if replyType == nil || replyType.Kind() != reflect.Ptr {
+		return nil, errors.New("rpc client - stream reply must be a pointer")
+	}
+
+	window := uint32(client.opt.StreamWindow)
+	if window == 0 {
+		window = DefaultStreamWindow
+	}
+	s := &ClientStream{
+		client: client,
+		ctx: ctx,
+		itemType: replyType.Elem(),
+		items: make(chan reflect.Value, window),
+		window: window,
+		end: make(chan struct{}),
+		windowUpdated: make(chan struct{}, 1),
+	}
+	call := newCall(ctx, serviceMethod, args, nil, make(chan *Call, 1))
+	call.stream = s
+	s.call = call
+
+	client.send(call)
+	if call.Seq == 0 {
+		// 请求没有注册成功，call 已经结束
+		return nil, (<- call.Done).Error
+	}
+	go s.watch()
+	return s, nil
+}
+
+// 等待流结束或 ctx 被取消
+func (s *ClientStream) watch() {
+	select {
+	case call := <- s.call.Done:
+		s.err = call.Error
+	case <- s.ctx.Done():
+		if s.client.removeCall(s.call.Seq) != nil {
+			s.client.cancel(s.call.Seq)
+			s.err = contextError("rpc client - stream failed", s.ctx.Err())
+			s.canceled = true
+		} else {
+			// 结束帧已经到达
+			s.err = (<- s.call.Done).Error
+		}
+	}
+	close(s.end)
+}
+
+// 接收一帧数据，由 receive 协程调用
+func (s *ClientStream) push(v reflect.Value) {
+	select {
+	case s.items <- v:
+	case <- s.end:
+	}
+}
+
+// 读取下一帧数据到 reply 中，reply 的类型与 Client.Stream 传入的相同
+// 流正常结束时返回 io.EOF，服务端返回错误或 ctx 被取消时返回对应的错误
+func (s *ClientStream) Recv(reply interface{}) error {
+	rv := reflect.ValueOf(reply)
+	if rv.Type() != reflect.PtrTo(s.itemType) {
+		return errors.New("rpc client - stream reply type mismatch: " + rv.Type().String())
+	}
+
+	var v reflect.Value
+	select {
+	case v = <- s.items:
+	case <- s.end:
+		if s.canceled {
+			return s.err
+		}
+		// 结束帧在所有数据帧之后到达，先读完缓冲中的数据
+		select {
+		case v = <- s.items:
+		default:
+			if s.err != nil {
+				return s.err
+			}
+			return io.EOF
+		}
+	}
+	rv.Elem().Set(v)
+
+	s.consumed++
+	if s.consumed >= windowThreshold(s.window) {
+		select {
+		case <- s.end:
+		default:
+			s.client.updateWindow(s.call.Seq, s.consumed)
+		}
+		s.consumed = 0
+	}
+	return nil
+}
+
+// 服务端归还了 n 帧的发送窗口，由 receive 协程调用
+func (s *ClientStream) updateWindow(n uint32) {
+	s.mutex.Lock()
+	if n == 0 {
+		s.sendRefused = true
+	}
+	s.sendWindow += n
+	s.mutex.Unlock()
+
+	select {
+	case s.windowUpdated <- struct{}{}:
+	default:
+	}
+}
+
+var errSendClosed = errors.New("rpc client - send on closed stream")
+
+// 对服务端流式方法调用 Send
+var errSendRefused = NewError(CodeInvalidArgument, "rpc client - send on a server stream, the method does not receive messages")
+
+// 向服务端发送一帧数据，只能用于双向流式方法，服务端的接收缓冲区满时阻塞
+// 流已经结束时返回 io.EOF，流结束的原因通过 Recv 得到；方法是服务端流式方法时返回错误码为 CodeInvalidArgument 的错误
+func (s *ClientStream) Send(args interface{}) error {
+	for {
+		select {
+		case <- s.end:
+			return io.EOF
+		default:
+		}
+
+		s.mutex.Lock()
+		if s.sendClosed {
+			s.mutex.Unlock()
+			return errSendClosed
+		}
+		if s.sendRefused {
+			s.mutex.Unlock()
+			return errSendRefused
+		}
+		if s.sendWindow > 0 {
+			s.sendWindow--
+			// 持有 s.mutex 发送，保证数据帧不会出现在结束帧之后
+			h := &codec.Header{ServiceMethod: s.call.ServiceMethod, Seq: s.call.Seq, Type: codec.MsgStream}
+			err := s.client.write(h, args)
+			s.mutex.Unlock()
+			return err
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <- s.windowUpdated:
+		case <- s.end:
+			return io.EOF
+		}
+	}
+}
+
+// 结束客户端到服务端方向的发送，服务端的 Recv 读完已发送的数据后返回 io.EOF，仍然可以继续调用 Recv
+func (s *ClientStream) CloseSend() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sendClosed {
+		return errSendClosed
+	}
+	s.sendClosed = true
+	select {
+	case <- s.end:
+		return nil
+	default:
+	}
+	return s.client.write(&codec.Header{ServiceMethod: s.call.ServiceMethod, Seq: s.call.Seq, Type: codec.MsgStreamEnd}, invalidRequest)
+}
+
+// 服务端返回的响应元数据，流结束之后才能读取
+func (s *ClientStream) Metadata() Metadata {
+	<- s.end
+	return s.call.Metadata
+}
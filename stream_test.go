@@ -0,0 +1,301 @@
+package violifer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"violifer/codec"
+)
+
+type Ticker struct {
+	// 已经发送的帧数
+	sent int64
+	// 方法的 ctx 结束时写入
+	canceled chan error
+}
+
+// 依次发送 0 到 args-1，args 为负数时发送 -args 帧后返回错误
+func (c *Ticker) Count(args int, stream *ServerStream[int]) error {
+	n, fail := args, false
+	if n < 0 {
+		n, fail = -n, true
+	}
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+		atomic.AddInt64(&c.sent, 1)
+	}
+	if fail {
+		return errors.New("count failed")
+	}
+	return nil
+}
+
+func (c *Ticker) Plain(args int, reply *int) error {
+	*reply = args
+	return nil
+}
+
+// 不断发送数据，直到 ctx 结束
+func (c *Ticker) Forever(ctx context.Context, args int, stream *ServerStream[int]) error {
+	for i := 0; ; i++ {
+		if err := stream.Send(i); err != nil {
+			c.canceled <- ctx.Err()
+			return err
+		}
+	}
+}
+
+func startTicker(t *testing.T, opt *Option) (*Ticker, *Client) {
+	ticker := &Ticker{canceled: make(chan error, 1)}
+	server := NewServer()
+	_ = server.Register(ticker)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), opt)
+	_assert(err == nil, "failed to dial: %v", err)
+	t.Cleanup(func() { _ = client.Close() })
+	return ticker, client
+}
+
+// 客户端按顺序收到全部数据后得到 io.EOF，服务端返回的错误在数据之后返回
+func TestClient_Stream(t *testing.T) {
+	t.Parallel()
+	_, client := startTicker(t, &Option{StreamWindow: 4})
+
+	stream, err := client.Stream(context.Background(), "Ticker.Count", 100, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	var got, item int
+	for err = stream.Recv(&item); err == nil; err = stream.Recv(&item) {
+		_assert(item == got, "expect %d, got %d", got, item)
+		got++
+	}
+	_assert(err == io.EOF && got == 100, "expect 100 items and io.EOF, got %d items and %v", got, err)
+
+	stream, err = client.Stream(context.Background(), "Ticker.Count", -3, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	got = 0
+	for err = stream.Recv(&item); err == nil; err = stream.Recv(&item) {
+		got++
+	}
+	_assert(got == 3 && strings.Contains(err.Error(), "count failed"), "expect 3 items and an error, got %d items and %v", got, err)
+
+	var sum int
+	err = client.Call(context.Background(), "Ticker.Count", 1, &sum)
+	_assert(err != nil && strings.Contains(err.Error(), "is a stream method"), "expect an error when calling a stream method with Call")
+	stream, err = client.Stream(context.Background(), "Ticker.Plain", 1, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	err = stream.Recv(&item)
+	_assert(err != nil && strings.Contains(err.Error(), "is not a stream method"), "expect an error when streaming a plain method")
+}
+
+// 服务端流式方法不接收客户端的数据，Send 立即返回错误而不是一直等待发送窗口
+func TestClient_StreamSendRefused(t *testing.T) {
+	t.Parallel()
+	_, client := startTicker(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Stream(ctx, "Ticker.Forever", 0, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	done := make(chan error, 1)
+	go func() {
+		done <- stream.Send(1)
+	}()
+	select {
+	case err = <-done:
+		_assert(CodeOf(err) == CodeInvalidArgument, "expect an invalid argument error, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect Send on a server stream to fail immediately")
+	}
+	var item int
+	_assert(stream.Recv(&item) == nil && item == 0, "expect the stream to keep working")
+}
+
+// 客户端不读取数据时，服务端发送的帧数不超过流控窗口
+func TestClient_StreamBackPressure(t *testing.T) {
+	t.Parallel()
+	ticker, client := startTicker(t, &Option{StreamWindow: 4})
+
+	stream, err := client.Stream(context.Background(), "Ticker.Count", 20, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	time.Sleep(time.Millisecond * 200)
+	_assert(atomic.LoadInt64(&ticker.sent) == 4, "expect the server to block after 4 items, sent %d", ticker.sent)
+
+	var item int
+	for i := 0; i < 2; i++ {
+		_ = stream.Recv(&item)
+	}
+	time.Sleep(time.Millisecond * 200)
+	_assert(atomic.LoadInt64(&ticker.sent) == 6, "expect the window to be returned, sent %d", ticker.sent)
+}
+
+// ctx 被取消时流关闭，服务端方法的 ctx 也被取消
+func TestClient_StreamCancel(t *testing.T) {
+	t.Parallel()
+	ticker, client := startTicker(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Stream(ctx, "Ticker.Forever", 0, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	var item int
+	_assert(stream.Recv(&item) == nil && item == 0, "failed to receive the first item")
+
+	cancel()
+	for err = stream.Recv(&item); err == nil; err = stream.Recv(&item) {
+	}
+	_assert(errors.Is(err, context.Canceled) && CodeOf(err) == CodeCanceled, "expect the stream to be canceled, got %v", err)
+	select {
+	case err = <-ticker.canceled:
+		_assert(errors.Is(err, context.Canceled), "expect the server ctx to be canceled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect the server method to stop")
+	}
+	_assert(client.IsAvailable(), "expect the client to be available")
+}
+
+type Chat struct {
+	// 阻塞 Stall 方法，直到被关闭
+	stall chan struct{}
+}
+
+// 将收到的每一条消息加上前缀后返回
+func (c *Chat) Echo(prefix string, stream *BidiStream[string, string]) error {
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(prefix + msg); err != nil {
+			return err
+		}
+	}
+}
+
+// 客户端流式调用，返回收到的所有数字之和
+func (c *Chat) Sum(args int, stream *BidiStream[*int, int]) error {
+	sum := args
+	for {
+		n, err := stream.Recv()
+		if err == io.EOF {
+			return stream.Send(sum)
+		}
+		if err != nil {
+			return err
+		}
+		sum += *n
+	}
+}
+
+// 不读取客户端发送的数据
+func (c *Chat) Stall(args int, stream *BidiStream[int, int]) error {
+	select {
+	case <-c.stall:
+	case <-stream.Context().Done():
+	}
+	return nil
+}
+
+func startChat(t *testing.T) (*Chat, *Client) {
+	chat := &Chat{stall: make(chan struct{})}
+	server := NewServer()
+	_ = server.Register(chat)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	t.Cleanup(func() {
+		close(chat.stall)
+		_ = client.Close()
+	})
+	return chat, client
+}
+
+// 双向流式调用中，客户端和服务端可以同时发送和接收，发送的帧数超过窗口时等待对方归还窗口
+func TestClient_BidiStream(t *testing.T) {
+	t.Parallel()
+	_, client := startChat(t)
+
+	stream, err := client.Stream(context.Background(), "Chat.Echo", "re: ", new(string))
+	_assert(err == nil, "failed to start stream: %v", err)
+	const n = DefaultStreamWindow * 3
+	go func() {
+		for i := 0; i < n; i++ {
+			_ = stream.Send(strings.Repeat("a", i))
+		}
+		_ = stream.CloseSend()
+	}()
+	var got int
+	var msg string
+	for err = stream.Recv(&msg); err == nil; err = stream.Recv(&msg) {
+		_assert(msg == "re: "+strings.Repeat("a", got), "unexpected message %q", msg)
+		got++
+	}
+	_assert(err == io.EOF && got == n, "expect %d messages and io.EOF, got %d and %v", n, got, err)
+	_assert(stream.Send("late") == io.EOF, "expect Send to fail after the stream ends")
+
+	stream, err = client.Stream(context.Background(), "Chat.Sum", 100, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	for i := 1; i <= 10; i++ {
+		_assert(stream.Send(&i) == nil, "failed to send %d", i)
+	}
+	_assert(stream.CloseSend() == nil, "failed to close send")
+	var sum int
+	_assert(stream.Recv(&sum) == nil && sum == 155, "expect sum 155, got %d", sum)
+	_assert(stream.Recv(&sum) == io.EOF, "expect io.EOF after the reply")
+}
+
+// 一个流的接收方处理慢时，发送方阻塞在自己的窗口上，同一连接上的其他调用不受影响
+func TestClient_StreamWindowIsolation(t *testing.T) {
+	t.Parallel()
+	_, client := startChat(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	stream, err := client.Stream(ctx, "Chat.Stall", 0, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	sent := 0
+	for ; stream.Send(sent) == nil; sent++ {
+		if sent == DefaultStreamWindow {
+			// 窗口用完之后 Send 阻塞，直到 ctx 结束
+			var reply string
+			err := client.Call(context.Background(), "Chat.Missing", "", &reply)
+			_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect other calls to proceed, got %v", err)
+		}
+	}
+	_assert(sent == DefaultStreamWindow, "expect Send to block after %d frames, sent %d", DefaultStreamWindow, sent)
+	_assert(client.IsAvailable(), "expect the client to be available")
+}
+
+// 客户端不遵守流控窗口时，服务端以 CodeInvalidArgument 结束整个流，而不是丢弃数据，连接上的其他调用不受影响
+func TestClient_StreamWindowExceeded(t *testing.T) {
+	t.Parallel()
+	_, client := startChat(t)
+
+	stream, err := client.Stream(context.Background(), "Chat.Stall", 0, new(int))
+	_assert(err == nil, "failed to start stream: %v", err)
+	// 绕过 ClientStream.Send 的窗口直接发送数据帧
+	h := &codec.Header{ServiceMethod: stream.call.ServiceMethod, Seq: stream.call.Seq, Type: codec.MsgStream}
+	for i := 0; i <= DefaultStreamWindow; i++ {
+		_assert(client.write(h, i) == nil, "failed to write frame %d", i)
+	}
+	var reply int
+	err = stream.Recv(&reply)
+	_assert(CodeOf(err) == CodeInvalidArgument && strings.Contains(err.Error(), "window exceeded"),
+		"expect the stream to end with a window error, got %v", err)
+
+	var msg string
+	err = client.Call(context.Background(), "Chat.Missing", "", &msg)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect other calls to proceed, got %v", err)
+}
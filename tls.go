@@ -0,0 +1,75 @@
+package violifer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// TLS 传输
+// 客户端在 Option.TLSConfig 中配置 TLS 后，Dial、DialHTTP 和 XDial 建立的连接都使用 TLS，
+// XDial 的 tls@host:port 格式使用 DialTLS 建立连接
+// 服务端通过 AcceptTLS 在 listener 上提供 TLS 服务，配置 ClientAuth 为 tls.RequireAndVerifyClientCert 即为双向认证，
+// 服务方法和拦截器可以通过 PeerFromContext 得到 Peer，再通过 Peer.Certificate 得到客户端证书
+
+// 使用 TLS 连接到 RPC 服务端，opt 中没有配置 TLSConfig 时使用系统的根证书验证服务端
+func DialTLS(network, address string, opts ...*Option) (*Client, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if opt.TLSConfig == nil {
+		// 复制一份，避免修改 DefaultOption 或调用方的 Option
+		o := *opt
+		o.TLSConfig = &tls.Config{}
+		opt = &o
+	}
+	return Dial(network, address, opt)
+}
+
+// 返回客户端使用的 TLS 配置，没有设置 ServerName 时使用地址中的主机名
+func clientTLSConfig(config *tls.Config, address string) *tls.Config {
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// 使 listener 以 TLS 的方式接收连接和服务请求
+func (server *Server) AcceptTLS(listener net.Listener, config *tls.Config) {
+	server.Accept(tls.NewListener(listener, config))
+}
+
+// 默认 Server 以 TLS 的方式接收连接和服务请求
+func AcceptTLS(listener net.Listener, config *tls.Config) {
+	DefaultServer.AcceptTLS(listener, config)
+}
+
+// 返回连接的 TLS 状态，不是 TLS 连接时返回 nil
+func (p *Peer) TLSState() *tls.ConnectionState {
+	return p.tlsState
+}
+
+// 返回经过验证的客户端证书，没有使用 TLS 或客户端证书没有经过验证时返回 nil
+// 客户端证书只有在服务端配置了 ClientCAs 并要求验证时才会经过验证
+func (p *Peer) Certificate() *x509.Certificate {
+	if p.tlsState == nil || len(p.tlsState.VerifiedChains) == 0 || len(p.tlsState.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return p.tlsState.VerifiedChains[0][0]
+}
+
+// 由经过验证的客户端证书得到客户端身份，没有客户端证书时返回 nil
+func (p *Peer) certificatePrincipal() *Principal {
+	cert := p.Certificate()
+	if cert == nil {
+		return nil
+	}
+	return &Principal{Scheme: SchemeTLS, Name: cert.Subject.CommonName}
+}
@@ -0,0 +1,121 @@
+package violifer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"violifer/codec"
+)
+
+// 签发证书，parent 为 nil 时生成自签名的 CA 证书
+func issueCert(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, serial int64) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_assert(err == nil, "failed to generate key: %v", err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{CommonName: cn},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		DNSNames: []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	_assert(err == nil, "failed to create certificate: %v", err)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type Whoami int
+
+// 返回客户端证书的 CommonName
+func (w Whoami) Name(ctx context.Context, args int, reply *string) error {
+	if peer, ok := PeerFromContext(ctx); ok && peer.Certificate() != nil {
+		*reply = peer.Certificate().Subject.CommonName
+	}
+	return nil
+}
+
+// 双向 TLS：服务端验证客户端证书，服务方法和拦截器都能得到客户端证书
+func TestServer_AcceptTLS(t *testing.T) {
+	t.Parallel()
+	caCert, caKey, _ := issueCert("test ca", nil, nil, 1)
+	_, _, serverCert := issueCert("server", caCert, caKey, 2)
+	_, _, clientCert := issueCert("alice", caCert, caKey, 3)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	server := NewServer()
+	_ = server.Register(new(Whoami))
+	seen := make(chan string, 1)
+	server.Use(func(ctx context.Context, serviceMethod string, h *codec.Header,
+		argv, replyv interface{}, next ServerHandler) error {
+		if peer, ok := PeerFromContext(ctx); ok && peer.Certificate() != nil {
+			seen <- peer.Certificate().Subject.CommonName
+		}
+		return next(ctx, argv, replyv)
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.AcceptTLS(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs: pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	})
+	addr := l.Addr().String()
+
+	t.Run("mutual tls", func(t *testing.T) {
+		client, err := XDial("tls@"+addr, &Option{
+			MagicNumber: MagicNumber,
+			CodecType: DefaultOption.CodecType,
+			TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}},
+		})
+		_assert(err == nil, "failed to dial with tls: %v", err)
+		defer func() { _ = client.Close() }()
+		var name string
+		err = client.Call(context.Background(), "Whoami.Name", 1, &name)
+		_assert(err == nil && name == "alice", "expect the method to see alice, got %q, %v", name, err)
+		_assert(<-seen == "alice", "expect the interceptor to see alice")
+	})
+	t.Run("no client certificate", func(t *testing.T) {
+		_, err := XDial("tls@"+addr, &Option{
+			MagicNumber: MagicNumber,
+			CodecType: DefaultOption.CodecType,
+			TLSConfig: &tls.Config{RootCAs: pool},
+			ConnectTimeout: time.Second,
+		})
+		_assert(err != nil, "expect a client without certificate to be rejected")
+	})
+	t.Run("unknown server", func(t *testing.T) {
+		_, err := XDial("tls@"+addr, &Option{
+			MagicNumber: MagicNumber,
+			CodecType: DefaultOption.CodecType,
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{clientCert}},
+			ConnectTimeout: time.Second,
+		})
+		_assert(err != nil && strings.Contains(err.Error(), "certificate"), "expect the server certificate to be rejected, got %v", err)
+	})
+	t.Run("plaintext", func(t *testing.T) {
+		_, err := Dial("tcp", addr, &Option{
+			MagicNumber: MagicNumber,
+			CodecType: DefaultOption.CodecType,
+			ConnectTimeout: time.Second,
+		})
+		_assert(err != nil, "expect a plaintext client to be rejected")
+	})
+}
@@ -68,7 +68,7 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
 }
 
 // 根据负载均衡策略选择一个服务实例
-func (d MultiServersDiscovery) Get(mode SelectMode) (string, error) {
+func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
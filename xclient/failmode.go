@@ -0,0 +1,60 @@
+package xclient
+
+// 选中的服务实例调用失败时的处理方式
+// 零值表示没有设置失败模式，按照 SetRetryPolicy 设置的重试策略处理，没有重试策略时不重试
+type FailMode int
+
+const (
+	failByPolicy FailMode = iota
+	// 立即返回错误，即使设置了重试策略也不重试
+	Failfast
+	// 按照重试策略重试同一个服务实例，忽略 SwitchServer
+	Failtry
+	// 按照 Discovery.GetAll 的顺序依次尝试其他服务实例，每个实例最多尝试一次，尝试次数不超过重试策略的 MaxAttempts
+	Failover
+)
+
+func (m FailMode) String() string {
+	switch m {
+	case failByPolicy:
+		return "policy"
+	case Failfast:
+		return "failfast"
+	case Failtry:
+		return "failtry"
+	case Failover:
+		return "failover"
+	}
+	return "unknown"
+}
+
+// 设置失败模式，默认按照重试策略处理
+func (xc *XClient) SetFailMode(mode FailMode) {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+
+	xc.failMode = mode
+}
+
+// Failover 时依次尝试的服务实例：从 rpcAddr 之后开始依次排列的其他实例
+func (xc *XClient) failoverServers(rpcAddr string) []string {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return nil
+	}
+	start := 0
+	for i, s := range servers {
+		if s == rpcAddr {
+			start = i + 1
+			break
+		}
+	}
+	others := make([]string, 0, len(servers))
+	for i := range servers {
+		s := servers[(start + i) % len(servers)]
+		if s != rpcAddr {
+			others = append(others, s)
+		}
+	}
+	return others
+}
@@ -0,0 +1,93 @@
+package xclient
+
+import (
+	"context"
+	"testing"
+	"time"
+	. "violifer"
+)
+
+// 返回服务实例的名称
+type Node string
+
+func (n Node) Name(args int, reply *string) error {
+	*reply = string(n)
+	return nil
+}
+
+// 启动 n 个服务实例
+func startNodes(n int) ([]*Server, []string) {
+	servers := make([]*Server, n)
+	addrs := make([]string, n)
+	for i := range servers {
+		server, l := startServer(Node(string(rune('a' + i))), "Name")
+		servers[i], addrs[i] = server, "tcp@" + l.Addr().String()
+	}
+	return servers, addrs
+}
+
+// 立即关闭服务实例，不等待正在处理的请求
+func kill(server *Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = server.Shutdown(ctx)
+}
+
+// 三个服务实例中的一个被关闭，轮询调用每个实例一次
+func TestXClient_FailMode(t *testing.T) {
+	tests := []struct {
+		mode FailMode
+		errors int
+	}{
+		// 没有设置失败模式时按照重试策略重试同一个实例
+		{failByPolicy, 1},
+		{Failfast, 1},
+		{Failtry, 1},
+		{Failover, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			servers, addrs := startNodes(3)
+			xc := NewXClient(NewMultiServerDiscovery(addrs), RoundRobinSelect, nil)
+			defer func() { _ = xc.Close() }()
+			xc.SetFailMode(tt.mode)
+			xc.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+			// 先与所有实例建立连接，再关闭其中一个
+			var name string
+			err := xc.Broadcast(context.Background(), "Node.Name", 0, &name)
+			_assert(err == nil, "failed to broadcast: %v", err)
+			kill(servers[0])
+			for _, server := range servers[1:] {
+				defer kill(server)
+			}
+			time.Sleep(time.Millisecond * 50)
+
+			errors := 0
+			for i := 0; i < len(servers); i++ {
+				name = ""
+				if err := xc.Call(context.Background(), "Node.Name", 0, &name); err != nil {
+					errors++
+					continue
+				}
+				_assert(name != "a", "expect no reply from the killed server")
+			}
+			_assert(errors == tt.errors, "expect %d errors, got %d", tt.errors, errors)
+		})
+	}
+}
+
+// 所有实例都不可用时 Failover 返回最后一次的错误
+func TestXClient_FailoverAllDown(t *testing.T) {
+	servers, addrs := startNodes(2)
+	for _, server := range servers {
+		kill(server)
+	}
+	xc := NewXClient(NewMultiServerDiscovery(addrs), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetFailMode(Failover)
+
+	var name string
+	err := xc.Call(context.Background(), "Node.Name", 0, &name)
+	_assert(err != nil, "expect an error when every server is down")
+}
@@ -0,0 +1,168 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"path"
+	"time"
+	. "violifer"
+)
+
+// 重试策略
+// 没有设置失败模式时，按照重试策略重试，SwitchServer 决定是否换一个服务实例；设置了失败模式时见 FailMode
+// 调用失败后，请求没有发送到服务端（建立连接失败、写入失败，即 *NotSentError）时总是可以重试，
+// 请求已经发送到服务端时，只有幂等方法才会重试，且错误码需要在 RetryableCodes 中
+// 幂等方法由服务端通过 Server.RegisterIdempotent 标记并在握手时告知客户端，也可以在 RetryPolicy.Idempotent 中配置
+type RetryPolicy struct {
+	// 最多尝试的次数，包括第一次调用，小于等于 1 时不重试
+	MaxAttempts int
+	// 第一次重试前的等待时间，之后每次翻倍
+	Backoff time.Duration
+	// 等待时间的上限，0 表示不限制
+	MaxBackoff time.Duration
+	// 幂等方法可以重试的错误码，为空时为 CodeUnavailable
+	RetryableCodes []Code
+	// 重试时换一个服务实例，没有其他实例时仍使用原来的实例，只在没有设置失败模式时生效
+	SwitchServer bool
+	// 客户端认为幂等的 ServiceMethod，支持 path.Match 的通配符，例如 "Arith.*"
+	Idempotent []string
+}
+
+// 失败模式为 Failtry 或 Failover 且没有设置重试策略时使用的策略
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts: 3,
+	Backoff: time.Millisecond * 10,
+	MaxBackoff: time.Second,
+}
+
+// 设置重试策略，nil 表示不重试；失败模式为 Failtry 或 Failover 时 nil 表示使用 DefaultRetryPolicy
+func (xc *XClient) SetRetryPolicy(policy *RetryPolicy) {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+
+	xc.retry = policy
+}
+
+// 客户端配置中 serviceMethod 是否为幂等方法
+func (p *RetryPolicy) idempotent(serviceMethod string) bool {
+	for _, pattern := range p.Idempotent {
+		if ok, _ := path.Match(pattern, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 调用失败后能否重试
+func (p *RetryPolicy) retryable(err error, idempotent bool) bool {
+	var notSent *NotSentError
+	if errors.As(err, &notSent) {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	codes := p.RetryableCodes
+	if len(codes) == 0 {
+		codes = []Code{CodeUnavailable}
+	}
+	code := CodeOf(err)
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// 第 attempt 次重试前的等待时间，attempt 从 1 开始
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// 服务端是否将 serviceMethod 注册为幂等方法
+func (xc *XClient) serverIdempotent(rpcAddr, serviceMethod string) bool {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+
+	if pool, ok := xc.pools[rpcAddr]; ok {
+		return pool.IsIdempotent(serviceMethod)
+	}
+	if client, ok := xc.clients[rpcAddr]; ok {
+		return client.IsIdempotent(serviceMethod)
+	}
+	return false
+}
+
+// 选择一个不同于 rpcAddr 的服务实例，没有其他实例时返回 rpcAddr
+func (xc *XClient) otherServer(rpcAddr string) string {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return rpcAddr
+	}
+	others := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if s != rpcAddr {
+			others = append(others, s)
+		}
+	}
+	if len(others) == 0 {
+		return rpcAddr
+	}
+	return others[rand.Intn(len(others))]
+}
+
+// 按照失败模式和重试策略调用 rpcAddr 上的服务方法
+func (xc *XClient) callWithRetry(rpcAddr string, ctx context.Context,
+		serviceMethod string, args, reply interface{}) error {
+	xc.mutex.Lock()
+	mode, policy := xc.failMode, xc.retry
+	xc.mutex.Unlock()
+
+	err := xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	if err == nil || mode == Failfast || (mode == failByPolicy && policy == nil) {
+		return err
+	}
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+	var others []string
+	if mode == Failover {
+		others = xc.failoverServers(rpcAddr)
+	}
+	for attempt := 1; err != nil && attempt < policy.MaxAttempts; attempt++ {
+		idempotent := policy.idempotent(serviceMethod) || xc.serverIdempotent(rpcAddr, serviceMethod)
+		if !policy.retryable(err, idempotent) {
+			return err
+		}
+		if mode == Failover {
+			// 其他实例都已经尝试过
+			if len(others) == 0 {
+				return err
+			}
+			rpcAddr, others = others[0], others[1:]
+		} else {
+			select {
+			case <- ctx.Done():
+				return err
+			case <- time.After(policy.backoff(attempt)):
+			}
+			if mode == failByPolicy && policy.SwitchServer {
+				rpcAddr = xc.otherServer(rpcAddr)
+			}
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		err = xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	. "violifer"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// 前 failures 次调用返回 code 错误
+type Flaky struct {
+	failures int32
+	code Code
+	calls int32
+}
+
+func (f *Flaky) fail() error {
+	if atomic.AddInt32(&f.calls, 1) <= f.failures {
+		return Errorf(f.code, "flaky call %d", atomic.LoadInt32(&f.calls))
+	}
+	return nil
+}
+
+func (f *Flaky) Get(args int, reply *int) error {
+	*reply = args
+	return f.fail()
+}
+
+func (f *Flaky) Charge(args int, reply *int) error {
+	*reply = args
+	return f.fail()
+}
+
+func startServer(rcvr interface{}, idempotent ...string) (*Server, net.Listener) {
+	server := NewServer()
+	if len(idempotent) > 0 {
+		_ = server.RegisterIdempotent(rcvr, idempotent...)
+	} else {
+		_ = server.Register(rcvr)
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	return server, l
+}
+
+// 返回一个没有监听的地址
+func deadAddr() string {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	_ = l.Close()
+	return "tcp@" + addr
+}
+
+// 请求到达服务端之后失败时，只重试幂等方法，且错误码可以重试
+func TestXClient_RetryIdempotent(t *testing.T) {
+	tests := []struct {
+		name string
+		method string
+		code Code
+		policy RetryPolicy
+		calls int32
+		ok bool
+	}{
+		{"server idempotent", "Flaky.Get", CodeUnavailable, RetryPolicy{MaxAttempts: 3}, 3, true},
+		{"not idempotent", "Flaky.Charge", CodeUnavailable, RetryPolicy{MaxAttempts: 3}, 1, false},
+		{"client idempotent", "Flaky.Charge", CodeUnavailable,
+			RetryPolicy{MaxAttempts: 3, Idempotent: []string{"Flaky.Ch*"}}, 3, true},
+		{"not retryable code", "Flaky.Get", CodeInvalidArgument, RetryPolicy{MaxAttempts: 3}, 1, false},
+		{"retryable code", "Flaky.Get", CodeInternal,
+			RetryPolicy{MaxAttempts: 3, RetryableCodes: []Code{CodeInternal}}, 3, true},
+		{"max attempts", "Flaky.Get", CodeUnavailable, RetryPolicy{MaxAttempts: 2}, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaky := &Flaky{failures: 2, code: tt.code}
+			_, l := startServer(flaky, "Get")
+			defer func() { _ = l.Close() }()
+			xc := NewXClient(NewMultiServerDiscovery([]string{"tcp@" + l.Addr().String()}), RandomSelect, nil)
+			defer func() { _ = xc.Close() }()
+			policy := tt.policy
+			policy.Backoff = time.Millisecond
+			xc.SetRetryPolicy(&policy)
+
+			var reply int
+			err := xc.Call(context.Background(), tt.method, 7, &reply)
+			_assert((err == nil) == tt.ok, "expect success %v, got %v", tt.ok, err)
+			_assert(atomic.LoadInt32(&flaky.calls) == tt.calls, "expect %d calls, got %d", tt.calls, flaky.calls)
+			if !tt.ok {
+				_assert(CodeOf(err) == tt.code, "expect the last error to be returned, got %v", err)
+			}
+		})
+	}
+}
+
+// 建立连接失败时请求没有发送到服务端，非幂等方法也会重试，SwitchServer 时换一个服务实例
+func TestXClient_RetryNotSent(t *testing.T) {
+	flaky := new(Flaky)
+	_, l := startServer(flaky)
+	defer func() { _ = l.Close() }()
+	dead := deadAddr()
+	d := NewMultiServerDiscovery([]string{dead, "tcp@" + l.Addr().String()})
+
+	xc := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetryPolicy(&RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond, SwitchServer: true})
+	for i := 0; i < 10; i++ {
+		var reply int
+		err := xc.Call(context.Background(), "Flaky.Charge", i, &reply)
+		_assert(err == nil && reply == i, "expect the call to move to the live server: %v", err)
+	}
+
+	// 不换服务实例时，同一个不可用的实例重试后仍然失败
+	xc = NewXClient(NewMultiServerDiscovery([]string{dead}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	var reply int
+	err := xc.Call(context.Background(), "Flaky.Charge", 1, &reply)
+	var notSent *NotSentError
+	_assert(errors.As(err, &notSent), "expect a NotSentError, got %v", err)
+}
+
+// 服务端在握手时告知客户端幂等方法
+func TestClient_IsIdempotent(t *testing.T) {
+	_, l := startServer(new(Flaky), "Get")
+	defer func() { _ = l.Close() }()
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.IsIdempotent("Flaky.Get") && !client.IsIdempotent("Flaky.Charge"), "unexpected idempotent methods")
+
+	err = NewServer().RegisterIdempotent(new(Flaky), "Missing")
+	_assert(err != nil, "expect marking a missing method to fail")
+}
@@ -20,6 +20,14 @@ type XClient struct {
 	mutex sync.Mutex
 	// 保存创建成功的 Client 实例
 	clients map[string]*Client
+	// 连接池选项，不为 nil 时每个地址使用一个连接池
+	poolOpt *PoolOption
+	// 每个地址的连接池
+	pools map[string]*Pool
+	// 调用失败时的处理方式，零值表示按照重试策略处理
+	failMode FailMode
+	// 重试策略，为 nil 时使用 DefaultRetryPolicy
+	retry *RetryPolicy
 }
 
 var _ io.Closer = (*XClient)(nil)
@@ -30,9 +38,18 @@ func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
 		mode:    mode,
 		opt:     opt,
 		clients: make(map[string]*Client),
+		pools:   make(map[string]*Pool),
 	}
 }
 
+// 为每个地址使用一个连接池代替单个 Client，nil 表示不使用连接池，已经创建了连接池的地址不受影响
+func (xc *XClient) SetPool(popt *PoolOption) {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+
+	xc.poolOpt = popt
+}
+
 func (xc *XClient) Close() error {
 	xc.mutex.Lock()
 	defer xc.mutex.Unlock()
@@ -41,9 +58,26 @@ func (xc *XClient) Close() error {
 		_ = client.Close()
 		delete(xc.clients, key)
 	}
+	for key, pool := range xc.pools {
+		_ = pool.Close()
+		delete(xc.pools, key)
+	}
 	return nil
 }
 
+// 返回地址对应的连接池，没有设置连接池选项时返回 nil
+func (xc *XClient) pool(rpcAddr string) *Pool {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+
+	pool, ok := xc.pools[rpcAddr]
+	if !ok && xc.poolOpt != nil {
+		pool = NewPool(rpcAddr, xc.opt, xc.poolOpt)
+		xc.pools[rpcAddr] = pool
+	}
+	return pool
+}
+
 func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	xc.mutex.Lock()
 	defer xc.mutex.Unlock()
@@ -51,8 +85,9 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	// 检查 xc.clients 是否有缓存的 Client
 	client, ok := xc.clients[rpcAddr]
 	// 能够获取到客户端，但客户端不可用
+	// 服务端正在关闭时，已经发出的调用仍会收到响应，等这些调用结束后再关闭
 	if ok && !client.IsAvailable() {
-		_ = client.Close()
+		_ = client.CloseWhenIdle()
 		delete(xc.clients, rpcAddr)
 		client = nil
 	}
@@ -71,9 +106,13 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 
 func (xc *XClient) call(rpcAddr string, ctx context.Context,
 		serviceMethod string, args, reply interface{}) error {
+	if pool := xc.pool(rpcAddr); pool != nil {
+		return pool.Call(ctx, serviceMethod, args, reply)
+	}
 	client, err := xc.dial(rpcAddr)
 	if err != nil {
-		return err
+		// 建立连接失败，请求没有发送到服务端
+		return &NotSentError{Err: err}
 	}
 	return client.Call(ctx, serviceMethod, args, reply)
 }
@@ -85,7 +124,7 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string,
 	if err != nil {
 		return err
 	}
-	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	return xc.callWithRetry(rpcAddr, ctx, serviceMethod, args, reply)
 }
 
 // Broadcast 将请求广播到所有的服务实例
@@ -101,6 +140,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 
 	replyDone := reply == nil
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
@@ -0,0 +1,45 @@
+package xclient
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Slow int
+
+// 等待 args 毫秒
+func (s Slow) Sleep(args int, reply *int) error {
+	time.Sleep(time.Duration(args) * time.Millisecond)
+	*reply = args
+	return nil
+}
+
+// 服务端正在关闭时，之后的调用丢弃缓存的连接，但不影响连接上已经发出的调用
+func TestXClient_DialGoingAway(t *testing.T) {
+	server, l := startServer(new(Slow))
+	xc := NewXClient(NewMultiServerDiscovery([]string{"tcp@" + l.Addr().String()}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var reply int
+	var err error
+	go func() {
+		defer wg.Done()
+		err = xc.Call(context.Background(), "Slow.Sleep", 300, &reply)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	go func() {
+		defer wg.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	var other int
+	e := xc.Call(context.Background(), "Slow.Sleep", 0, &other)
+	_assert(e != nil, "expect the call after shutdown to fail")
+	wg.Wait()
+	_assert(err == nil && reply == 300, "expect the in-flight call to complete: %v", err)
+}